@@ -0,0 +1,126 @@
+package configcat
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultAutoOfflineFailureThreshold is the default
+	// value of AutoOfflinePolicy.FailureThreshold.
+	DefaultAutoOfflineFailureThreshold = 3
+
+	// DefaultAutoOfflineProbeInterval is the default
+	// value of AutoOfflinePolicy.ProbeInterval.
+	DefaultAutoOfflineProbeInterval = 5 * time.Minute
+)
+
+// AutoOfflinePolicy describes when the client switches to offline
+// mode by itself because the CDN can't be reached, and how it finds
+// out that the CDN is reachable again.
+//
+// After FailureThreshold consecutive fetches have failed with a
+// network error (a timeout or a failed connection), the client goes
+// offline and serves the configuration from Config.Cache. While it's
+// offline, the refreshes it does anyway (every Config.PollInterval
+// in AutoPoll mode) probe the CDN at most once per ProbeInterval,
+// and the client goes back online as soon as a probe succeeds.
+// Client.RefreshIfOlder probes the CDN straight away when the
+// configuration is older than requested.
+//
+// Client.SetOffline and Client.SetOnline take precedence: a client
+// set offline explicitly doesn't probe the CDN.
+type AutoOfflinePolicy struct {
+	// FailureThreshold holds the number of consecutive network
+	// failures after which the client goes offline. If it's less
+	// than 1, DefaultAutoOfflineFailureThreshold is used.
+	FailureThreshold int
+
+	// ProbeInterval holds the minimum delay between two probes
+	// of the CDN while the client is offline. If it's less than 1,
+	// DefaultAutoOfflineProbeInterval is used.
+	ProbeInterval time.Duration
+}
+
+func (p *AutoOfflinePolicy) failureThreshold() int {
+	if p.FailureThreshold < 1 {
+		return DefaultAutoOfflineFailureThreshold
+	}
+	return p.FailureThreshold
+}
+
+func (p *AutoOfflinePolicy) probeInterval() time.Duration {
+	if p.ProbeInterval < 1 {
+		return DefaultAutoOfflineProbeInterval
+	}
+	return p.ProbeInterval
+}
+
+// The values of configFetcher.offline.
+const (
+	modeOnline uint32 = iota
+	// modeOffline is set by Client.SetOffline or Config.Offline.
+	modeOffline
+	// modeAutoOffline is set after repeated network failures.
+	modeAutoOffline
+)
+
+// probeDue reports whether the fetcher went offline by itself
+// and it's time to probe the CDN again.
+func (f *configFetcher) probeDue() bool {
+	return atomic.LoadUint32(&f.offline) == modeAutoOffline &&
+		(atomic.LoadUint32(&f.probeRequested) == 1 || time.Since(f.lastProbe) >= f.autoOffline.probeInterval())
+}
+
+// requestProbe makes the next fetch probe the CDN if the fetcher
+// went offline by itself and reports whether it did.
+func (f *configFetcher) requestProbe() bool {
+	if atomic.LoadUint32(&f.offline) != modeAutoOffline {
+		return false
+	}
+	atomic.StoreUint32(&f.probeRequested, 1)
+	return true
+}
+
+// checkConnectivity switches the fetcher offline or back online as
+// described by f.autoOffline after an HTTP fetch that completed with
+// the given error.
+func (f *configFetcher) checkConnectivity(err error) {
+	if f.autoOffline == nil {
+		return
+	}
+	atomic.StoreUint32(&f.probeRequested, 0)
+	var fErr *fetcherError
+	if errors.As(err, &fErr) && fErr.isNetworkError() {
+		f.networkFailures++
+		f.lastProbe = time.Now()
+		if f.networkFailures >= f.autoOffline.failureThreshold() && atomic.CompareAndSwapUint32(&f.offline, modeOnline, modeAutoOffline) {
+			f.logger.Warnf(5200, "switched to OFFLINE mode after %d consecutive network failures; probing the CDN every %v", f.networkFailures, f.autoOffline.probeInterval())
+			f.networkFailures = 0
+			f.stateChanged(true)
+		}
+		return
+	}
+	f.networkFailures = 0
+	if atomic.CompareAndSwapUint32(&f.offline, modeAutoOffline, modeOnline) {
+		f.logger.Infof(5200, "switched to ONLINE mode: the CDN is reachable again")
+		f.stateChanged(false)
+	}
+}
+
+// stateChanged calls the OnStateChange hook.
+func (f *configFetcher) stateChanged(offline bool) {
+	if hooks := f.hooks; hooks != nil && hooks.OnStateChange != nil {
+		hooks.dispatch(func() {
+			hooks.OnStateChange(offline)
+		})
+	}
+}
+
+// isNetworkError reports whether the fetch failed
+// without the server being reached, that is, whether
+// the failure is transient without an HTTP response.
+func (f *fetcherError) isNetworkError() bool {
+	return f.isTransient() && f.statusCode == 0
+}
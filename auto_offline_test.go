@@ -0,0 +1,157 @@
+package configcat
+
+import (
+	"context"
+	"errors"
+	"github.com/configcat/go-sdk/v9/configcatcache"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_AutoOffline(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value1"))
+	transport := &flakyTransport{}
+	states := make(chan bool, 10)
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.Transport = transport
+	cfg.Cache = &customCache{items: make(map[string]string)}
+	cfg.AutoOffline = &AutoOfflinePolicy{
+		FailureThreshold: 2,
+		ProbeInterval:    50 * time.Millisecond,
+	}
+	cfg.Hooks = &Hooks{OnStateChange: func(offline bool) {
+		states <- offline
+	}}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+
+	atomic.StoreInt32(&transport.down, 1)
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(client.IsOffline(), qt.IsFalse)
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(client.IsOffline(), qt.IsTrue)
+	c.Assert(receiveState(c, states), qt.IsTrue)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	// No requests are made until a probe is due.
+	atomic.StoreInt32(&transport.down, 0)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	requests := atomic.LoadInt32(&transport.requests)
+	_ = client.Refresh(context.Background())
+	c.Assert(atomic.LoadInt32(&transport.requests), qt.Equals, requests)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.IsOffline(), qt.IsFalse)
+	c.Assert(receiveState(c, states), qt.IsFalse)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2")
+}
+
+func TestClient_AutoOffline_RefreshIfOlderProbes(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value1"))
+	transport := &flakyTransport{}
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.Transport = transport
+	cfg.Cache = configcatcache.NewMemoryCache()
+	cfg.AutoOffline = &AutoOfflinePolicy{
+		FailureThreshold: 1,
+		ProbeInterval:    time.Hour,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	atomic.StoreInt32(&transport.down, 1)
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(client.IsOffline(), qt.IsTrue)
+
+	// RefreshIfOlder probes the CDN without waiting for the probe interval.
+	atomic.StoreInt32(&transport.down, 0)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	c.Assert(client.RefreshIfOlder(context.Background(), 0), qt.IsNil)
+	c.Assert(client.IsOffline(), qt.IsFalse)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2")
+
+	// A client set offline explicitly still refuses.
+	client.SetOffline()
+	c.Assert(client.RefreshIfOlder(context.Background(), 0), qt.ErrorMatches, "client is in offline mode.*")
+}
+
+func TestClient_AutoOffline_ManualOverride(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	transport := &flakyTransport{down: 1}
+	states := make(chan bool, 10)
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.Transport = transport
+	cfg.AutoOffline = &AutoOfflinePolicy{
+		FailureThreshold: 1,
+		ProbeInterval:    10 * time.Millisecond,
+	}
+	cfg.Hooks = &Hooks{OnStateChange: func(offline bool) {
+		states <- offline
+	}}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(client.IsOffline(), qt.IsTrue)
+	c.Assert(receiveState(c, states), qt.IsTrue)
+
+	// Once set offline explicitly, the client doesn't probe.
+	client.SetOffline()
+	requests := atomic.LoadInt32(&transport.requests)
+	time.Sleep(20 * time.Millisecond)
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(atomic.LoadInt32(&transport.requests), qt.Equals, requests)
+
+	atomic.StoreInt32(&transport.down, 0)
+	client.SetOnline()
+	c.Assert(receiveState(c, states), qt.IsFalse)
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value")
+	select {
+	case offline := <-states:
+		t.Fatalf("unexpected state change: %v", offline)
+	default:
+	}
+}
+
+// flakyTransport fails requests with a network error while down is 1.
+type flakyTransport struct {
+	down     int32
+	requests int32
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.requests, 1)
+	if atomic.LoadInt32(&t.down) == 1 {
+		return nil, errors.New("network is unreachable")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func receiveState(c *qt.C, states <-chan bool) bool {
+	select {
+	case offline := <-states:
+		return offline
+	case <-time.After(time.Second):
+		c.Fatalf("timed out waiting for OnStateChange")
+		return false
+	}
+}
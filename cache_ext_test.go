@@ -0,0 +1,137 @@
+package configcat
+
+import (
+	"context"
+	"github.com/configcat/go-sdk/v9/configcatcache"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var _ ConfigCacheExt = (*configcatcache.MemoryCache)(nil)
+
+func TestCacheExt_NoRegression(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{
+		body:  marshalJSON(rootNodeWithKeyValue("key", "value1")),
+		sleep: 50 * time.Millisecond,
+	})
+	cache := configcatcache.NewMemoryCache()
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Cache = cache
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	cacheKey := client.fetcher.(*configFetcher).cacheKey
+
+	done := make(chan error)
+	go func() {
+		done <- client.Refresh(context.Background())
+	}()
+	// Another instance writes a more recent fetch while ours is in progress.
+	time.Sleep(20 * time.Millisecond)
+	newer := configcatcache.CacheEntryToBytes(time.Now().Add(time.Minute), "newer", []byte(marshalJSON(rootNodeWithKeyValue("key", "value2"))))
+	c.Assert(cache.Set(context.Background(), cacheKey, newer), qt.IsNil)
+	c.Assert(<-done, qt.IsNil)
+
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+	cached, _ := cache.Get(context.Background(), cacheKey)
+	_, etag, _, err := configcatcache.CacheSegmentsFromBytes(cached)
+	c.Assert(err, qt.IsNil)
+	c.Assert(etag, qt.Equals, "newer")
+}
+
+func TestCacheExt_KeepInvalid(t *testing.T) {
+	c := qt.New(t)
+	cache := configcatcache.NewMemoryCache()
+	cfg := Config{
+		SDKKey:      randomSdkKey(),
+		PollingMode: Manual,
+		Offline:     true,
+		Cache:       cache,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelNone,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	cacheKey := client.fetcher.(*configFetcher).cacheKey
+	c.Assert(cache.Set(context.Background(), cacheKey, []byte("garbage")), qt.IsNil)
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	// The entry may belong to a newer SDK sharing the cache.
+	cached, _ := cache.Get(context.Background(), cacheKey)
+	c.Assert(string(cached), qt.Equals, "garbage")
+}
+
+func TestCacheExt_TTL(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cache := configcatcache.NewMemoryCache()
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Cache = cache
+	cfg.CacheTTL = 20 * time.Millisecond
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	cacheKey := client.fetcher.(*configFetcher).cacheKey
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	cached, _ := cache.Get(context.Background(), cacheKey)
+	c.Assert(cached, qt.Not(qt.HasLen), 0)
+	time.Sleep(30 * time.Millisecond)
+	cached, _ = cache.Get(context.Background(), cacheKey)
+	c.Assert(cached, qt.IsNil)
+}
+
+func TestCacheExt_TTLWithoutExt(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	logger := newTestLogger(t).(*testLogger)
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Cache = &customCache{items: make(map[string]string)}
+	cfg.CacheTTL = time.Minute
+	cfg.Logger = logger
+	cfg.LogLevel = LogLevelWarn
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(logger.Logs(), qt.Contains, "WARN: [0] CacheTTL is ignored because the cache doesn't implement ConfigCacheExt")
+}
+
+func TestMemoryCache_CompareAndSet(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	cache := configcatcache.NewMemoryCache()
+	fetchTime := time.Now()
+	entry1 := configcatcache.CacheSegmentsToBytes(fetchTime, "etag1", []byte(`{}`))
+	entry2 := configcatcache.CacheSegmentsToBytes(fetchTime, "etag2", []byte(`{}`))
+	// entry3 has the same ETag as entry2 but a later fetch time.
+	entry3 := configcatcache.CacheSegmentsToBytes(fetchTime.Add(time.Second), "etag2", []byte(`{}`))
+
+	ok, err := cache.CompareAndSet(ctx, "key", entry1, entry2, 0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+	ok, _ = cache.CompareAndSet(ctx, "key", entry1, nil, 0)
+	c.Assert(ok, qt.IsTrue)
+	ok, _ = cache.CompareAndSet(ctx, "key", entry2, nil, 0)
+	c.Assert(ok, qt.IsFalse)
+	ok, _ = cache.CompareAndSet(ctx, "key", entry2, entry1, 0)
+	c.Assert(ok, qt.IsTrue)
+	ok, _ = cache.CompareAndSet(ctx, "key", entry1, entry3, 0)
+	c.Assert(ok, qt.IsFalse)
+	value, _ := cache.Get(ctx, "key")
+	c.Assert(value, qt.DeepEquals, entry2)
+
+	// An invalid entry is compared like any other.
+	c.Assert(cache.Set(ctx, "key", []byte("garbage")), qt.IsNil)
+	ok, _ = cache.CompareAndSet(ctx, "key", entry1, nil, 0)
+	c.Assert(ok, qt.IsFalse)
+	ok, _ = cache.CompareAndSet(ctx, "key", entry1, []byte("garbage"), 0)
+	c.Assert(ok, qt.IsTrue)
+
+	c.Assert(cache.Delete(ctx, "key"), qt.IsNil)
+	value, _ = cache.Get(ctx, "key")
+	c.Assert(value, qt.IsNil)
+}
@@ -0,0 +1,130 @@
+package configcat
+
+import (
+	"context"
+	"github.com/configcat/go-sdk/v9/configcatcache"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var _ ConfigCacheLocker = (*configcatcache.MemoryLock)(nil)
+
+func TestCacheLock_OnlyLeaderFetches(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Cache = configcatcache.NewMemoryLock(configcatcache.NewMemoryCache())
+
+	client1 := NewCustomClient(cfg)
+	defer client1.Close()
+	client2 := NewCustomClient(cfg)
+	defer client2.Close()
+
+	c.Assert(client1.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+
+	// The second client reads what the leader has written to the cache.
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+	c.Assert(client2.GetStringValue("key", "", nil), qt.Equals, "value")
+
+	// Once the leader goes away, the second client takes over.
+	client1.Close()
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 2)
+	c.Assert(client2.GetStringValue("key", "", nil), qt.Equals, "value2")
+}
+
+func TestCacheLock_LeaseExpiry(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.PollInterval = 100 * time.Millisecond
+	cfg.Cache = configcatcache.NewFileLock(configcatcache.NewMemoryCache(), t.TempDir())
+
+	client1 := NewCustomClient(cfg)
+	defer client1.Close()
+	client2 := NewCustomClient(cfg)
+	defer client2.Close()
+
+	c.Assert(client1.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+
+	// The leader stops fetching without releasing the lock, so
+	// the lease expires and the second client becomes the leader.
+	time.Sleep(3 * cfg.PollInterval)
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 2)
+}
+
+func TestCacheLock_IdleLazyLeader(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value1"))
+	cfg := srv.config()
+	cfg.PollingMode = Lazy
+	cfg.PollInterval = 20 * time.Millisecond
+	cfg.Cache = configcatcache.NewMemoryLock(configcatcache.NewMemoryCache())
+
+	client1 := NewCustomClient(cfg)
+	defer client1.Close()
+	client2 := NewCustomClient(cfg)
+	defer client2.Close()
+	c.Assert(client1.GetStringValue("key", "", nil), qt.Equals, "value1")
+	c.Assert(client2.GetStringValue("key", "", nil), qt.Equals, "value1")
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+
+	// The leader isn't used anymore, so the follower takes over.
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	waitFor(t, func() bool {
+		return client2.GetStringValue("key", "", nil) == "value2"
+	})
+}
+
+func TestCacheLock_MemoryCacheDoesNotLock(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Cache = configcatcache.NewMemoryCache()
+
+	client1 := NewCustomClient(cfg)
+	defer client1.Close()
+	client2 := NewCustomClient(cfg)
+	defer client2.Close()
+	c.Assert(client1.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 2)
+}
+
+func TestCacheLock_FollowerWithoutConfig(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cache := configcatcache.NewMemoryCache()
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Cache = configcatcache.NewMemoryLock(cache)
+
+	client1 := NewCustomClient(cfg)
+	defer client1.Close()
+	client2 := NewCustomClient(cfg)
+	defer client2.Close()
+	c.Assert(client1.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+
+	// When the cache loses its entry, the follower can't refresh.
+	c.Assert(cache.Delete(context.Background(), client2.fetcher.(*configFetcher).cacheKey), qt.IsNil)
+	c.Assert(client2.Refresh(context.Background()), qt.ErrorMatches, ".*another instance holds the cache lock.*")
+	c.Assert(client2.GetStringValue("key", "", nil), qt.Equals, "value")
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+}
@@ -0,0 +1,108 @@
+package configcat
+
+import (
+	"context"
+	"time"
+)
+
+// ClientCacheState describes the feature flag data a client can evaluate with.
+type ClientCacheState int
+
+const (
+	// NoFlagData means that the client has no feature flag data
+	// yet, so every evaluation returns the default value.
+	NoFlagData ClientCacheState = iota
+
+	// HasLocalOverrideFlagDataOnly means that the client only
+	// evaluates the flag overrides (the overrides behavior is
+	// LocalOnly), so it never uses data from ConfigCat.
+	HasLocalOverrideFlagDataOnly
+
+	// HasCachedFlagDataOnly means that the client evaluates with
+	// feature flag data that's older than the poll interval plus
+	// the time a fetch may take (or, when the polling mode is
+	// Manual, that was read from the cache), typically because it
+	// couldn't be refreshed from ConfigCat. Feature flag data kept
+	// up to date by a connected config stream is never considered
+	// cached only.
+	HasCachedFlagDataOnly
+
+	// HasUpToDateFlagData means that the client evaluates with
+	// feature flag data that has been fetched from ConfigCat
+	// (or by another instance sharing the cache) recently.
+	HasUpToDateFlagData
+)
+
+func (s ClientCacheState) String() string {
+	switch s {
+	case NoFlagData:
+		return "NoFlagData"
+	case HasLocalOverrideFlagDataOnly:
+		return "HasLocalOverrideFlagDataOnly"
+	case HasCachedFlagDataOnly:
+		return "HasCachedFlagDataOnly"
+	case HasUpToDateFlagData:
+		return "HasUpToDateFlagData"
+	}
+	return "UNKNOWN"
+}
+
+// WaitForReady waits until the client is ready (see Ready) or the
+// context is done, whichever comes first, and returns the state
+// of the feature flag data the client evaluates with at that point.
+func (client *Client) WaitForReady(ctx context.Context) ClientCacheState {
+	select {
+	case <-client.ready:
+	case <-ctx.Done():
+	}
+	return client.cacheState()
+}
+
+// cacheState returns the current state of the client's feature flag data.
+func (client *Client) cacheState() ClientCacheState {
+	if client.cfg.FlagOverrides != nil && client.cfg.FlagOverrides.Behavior == LocalOnly {
+		return HasLocalOverrideFlagDataOnly
+	}
+	cfg := client.fetcher.current()
+	if cfg == nil {
+		return NoFlagData
+	}
+	polling := client.pollingState()
+	switch {
+	case polling.mode == Manual:
+		// The poll interval doesn't apply.
+		if cfg.fromCache {
+			return HasCachedFlagDataOnly
+		}
+	case client.fetcher.isStreaming():
+		// The fetch time only changes when an event is received.
+	case time.Since(cfg.fetchTime) > polling.interval+client.fetchSlack(polling.interval):
+		return HasCachedFlagDataOnly
+	}
+	return HasUpToDateFlagData
+}
+
+// fetchSlack returns how much longer than the poll interval
+// the configuration may be before it's refreshed: the time
+// a fetch may take, or the poll interval when there's no
+// HTTP timeout.
+func (client *Client) fetchSlack(interval time.Duration) time.Duration {
+	if client.cfg.HTTPTimeout > 0 {
+		return client.cfg.HTTPTimeout
+	}
+	return interval
+}
+
+// notifyReady calls onReady with the cache state
+// once the client is ready, unless it's closed first.
+func (client *Client) notifyReady(onReady func(state ClientCacheState)) {
+	select {
+	case <-client.ready:
+	case <-client.fetcher.context().Done():
+		return
+	}
+	state := client.cacheState()
+	client.cfg.Hooks.dispatch(func() {
+		onReady(state)
+	})
+}
@@ -0,0 +1,360 @@
+package configcat
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultClientManagerWorkers holds the default value of ClientManagerConfig.Workers.
+const DefaultClientManagerWorkers = 8
+
+// ClientManagerConfig describes configuration options for a ClientManager.
+type ClientManagerConfig struct {
+	// Config holds the configuration used to create each client.
+	// Its SDKKey is replaced by the key passed to ClientManager.Get
+	// and its PollingMode is ignored: the clients are refreshed by
+	// the manager every Config.PollInterval.
+	//
+	// All the clients use Config.Transport (http.DefaultTransport
+	// if it's nil), so they share a single pool of connections.
+	Config Config
+
+	// Workers holds the maximum number of concurrent refreshes.
+	// If it's less than 1, DefaultClientManagerWorkers is used.
+	Workers int
+
+	// IdleTTL holds how long a client can go without being
+	// returned by ClientManager.Get before it's closed and
+	// removed from the manager. Idle clients are evicted when
+	// they're next due for a refresh. If it's zero,
+	// clients are never evicted.
+	IdleTTL time.Duration
+}
+
+// ClientManagerStats holds statistics about a ClientManager.
+type ClientManagerStats struct {
+	// Clients holds the number of clients currently held by the manager.
+	Clients int
+
+	// Refreshes holds the total number of refreshes made by the manager.
+	Refreshes uint64
+
+	// FailedRefreshes holds how many of those refreshes failed.
+	FailedRefreshes uint64
+
+	// Evictions holds the total number of clients evicted
+	// because they were idle.
+	Evictions uint64
+}
+
+// ClientManager manages clients for many SDK keys, for example
+// in a service that serves many tenants. It creates clients lazily
+// and refreshes all of them from a fixed pool of worker goroutines
+// rather than running a poller per client.
+type ClientManager struct {
+	// Note: these are accessed atomically and kept first
+	// to guarantee their 64-bit alignment.
+	refreshes       uint64
+	failedRefreshes uint64
+	evictions       uint64
+
+	cfg          Config
+	workers      int
+	idleTTL      time.Duration
+	pollInterval time.Duration
+
+	ctx       context.Context
+	ctxCancel func()
+	wg        sync.WaitGroup
+	jobs      chan *managedClient
+
+	// wake is notified when the earliest due time may have changed.
+	wake chan struct{}
+
+	mu      sync.Mutex
+	clients map[string]*managedClient
+	queue   refreshQueue
+	closed  bool
+}
+
+// managedClient holds a client and its scheduling state. Its fields
+// other than created, client and ready are guarded by ClientManager.mu.
+type managedClient struct {
+	sdkKey string
+
+	// created is closed once client has been set.
+	created chan struct{}
+	client  *Client
+
+	// ready is closed when the first refresh has completed.
+	ready chan struct{}
+
+	lastUsed time.Time
+	due      time.Time
+
+	// index holds the index in the refresh queue,
+	// or -1 when the client isn't in the queue.
+	index int
+}
+
+// markReady closes mc.ready if it's not already closed.
+// It must not be called concurrently for the same client,
+// which is guaranteed because a client is only handled by one
+// worker at a time.
+func (mc *managedClient) markReady() {
+	select {
+	case <-mc.ready:
+	default:
+		close(mc.ready)
+	}
+}
+
+// NewClientManager returns a new ClientManager. It should be
+// closed with Close when it's not needed anymore.
+func NewClientManager(cfg ClientManagerConfig) *ClientManager {
+	m := &ClientManager{
+		cfg:          cfg.Config,
+		workers:      cfg.Workers,
+		idleTTL:      cfg.IdleTTL,
+		pollInterval: cfg.Config.PollInterval,
+		jobs:         make(chan *managedClient),
+		wake:         make(chan struct{}, 1),
+		clients:      make(map[string]*managedClient),
+	}
+	if m.workers < 1 {
+		m.workers = DefaultClientManagerWorkers
+	}
+	if m.pollInterval < 1 {
+		m.pollInterval = DefaultPollInterval
+	}
+	m.cfg.PollingMode = Manual
+	m.ctx, m.ctxCancel = context.WithCancel(context.Background())
+	m.wg.Add(m.workers + 1)
+	go m.runScheduler()
+	for i := 0; i < m.workers; i++ {
+		go m.runWorker()
+	}
+	return m
+}
+
+// Get returns the client for the given SDK key, creating it if needed.
+// When the client is created, Get waits for its first refresh to
+// complete or for ctx to be done, whichever comes first.
+//
+// The returned client is owned by the manager and
+// must not be closed by the caller. Get returns nil
+// if the manager has been closed.
+func (m *ClientManager) Get(ctx context.Context, sdkKey string) *Client {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	mc := m.clients[sdkKey]
+	if mc == nil {
+		mc = &managedClient{
+			sdkKey:  sdkKey,
+			created: make(chan struct{}),
+			ready:   make(chan struct{}),
+			index:   -1,
+		}
+		m.clients[sdkKey] = mc
+		mc.lastUsed = time.Now()
+		m.mu.Unlock()
+		// Other callers asking for the same key in the
+		// meantime wait for mc.created.
+		m.create(mc)
+	} else {
+		mc.lastUsed = time.Now()
+		m.mu.Unlock()
+	}
+	<-mc.created
+	select {
+	case <-mc.ready:
+	case <-ctx.Done():
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil
+	}
+	return mc.client
+}
+
+// create creates the client of mc and schedules its first refresh.
+func (m *ClientManager) create(mc *managedClient) {
+	cfg := m.cfg
+	cfg.SDKKey = mc.sdkKey
+	client := NewCustomClient(cfg)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mc.client = client
+	close(mc.created)
+	if m.closed {
+		// Close takes care of the client.
+		return
+	}
+	// Schedule the first refresh immediately.
+	mc.due = time.Now()
+	heap.Push(&m.queue, mc)
+	m.notify()
+}
+
+// Stats returns statistics about the manager.
+func (m *ClientManager) Stats() ClientManagerStats {
+	m.mu.Lock()
+	clients := len(m.clients)
+	m.mu.Unlock()
+	return ClientManagerStats{
+		Clients:         clients,
+		Refreshes:       atomic.LoadUint64(&m.refreshes),
+		FailedRefreshes: atomic.LoadUint64(&m.failedRefreshes),
+		Evictions:       atomic.LoadUint64(&m.evictions),
+	}
+}
+
+// Close stops all refreshes and closes all the clients.
+// The manager shouldn't be used after closing.
+func (m *ClientManager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	m.mu.Unlock()
+	m.ctxCancel()
+	m.wg.Wait()
+	m.mu.Lock()
+	clients := m.clients
+	m.clients = make(map[string]*managedClient)
+	m.queue = nil
+	m.mu.Unlock()
+	for _, mc := range clients {
+		<-mc.created
+		mc.markReady()
+		mc.client.Close()
+	}
+}
+
+// notify wakes up the scheduler. It must be called with m.mu held.
+func (m *ClientManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runScheduler hands clients over to the workers when they're due
+// for a refresh, evicting those that have been idle for too long.
+func (m *ClientManager) runScheduler() {
+	defer m.wg.Done()
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		m.mu.Lock()
+		var mc *managedClient
+		wait := time.Hour
+		if len(m.queue) > 0 {
+			if d := time.Until(m.queue[0].due); d > 0 {
+				wait = d
+			} else {
+				mc = heap.Pop(&m.queue).(*managedClient)
+			}
+		}
+		var evict bool
+		if mc != nil && m.idleTTL > 0 && time.Since(mc.lastUsed) > m.idleTTL {
+			delete(m.clients, mc.sdkKey)
+			evict = true
+		}
+		m.mu.Unlock()
+
+		switch {
+		case evict:
+			atomic.AddUint64(&m.evictions, 1)
+			mc.client.Close()
+		case mc != nil:
+			select {
+			case m.jobs <- mc:
+			case <-m.ctx.Done():
+				return
+			}
+		default:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-m.wake:
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (m *ClientManager) runWorker() {
+	defer m.wg.Done()
+	for {
+		var mc *managedClient
+		select {
+		case mc = <-m.jobs:
+		case <-m.ctx.Done():
+			return
+		}
+		err := mc.client.Refresh(m.ctx)
+		if m.ctx.Err() != nil {
+			return
+		}
+		atomic.AddUint64(&m.refreshes, 1)
+		if err != nil {
+			atomic.AddUint64(&m.failedRefreshes, 1)
+		}
+		m.mu.Lock()
+		mc.markReady()
+		delay := m.pollInterval
+		if d := retryAfter(err); d > delay {
+			delay = d
+		}
+		mc.due = time.Now().Add(delay)
+		heap.Push(&m.queue, mc)
+		m.notify()
+		m.mu.Unlock()
+	}
+}
+
+// refreshQueue implements heap.Interface, ordering
+// clients by the time they're due for a refresh.
+type refreshQueue []*managedClient
+
+func (q refreshQueue) Len() int {
+	return len(q)
+}
+
+func (q refreshQueue) Less(i, j int) bool {
+	return q[i].due.Before(q[j].due)
+}
+
+func (q refreshQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *refreshQueue) Push(x interface{}) {
+	mc := x.(*managedClient)
+	mc.index = len(*q)
+	*q = append(*q, mc)
+}
+
+func (q *refreshQueue) Pop() interface{} {
+	old := *q
+	mc := old[len(old)-1]
+	old[len(old)-1] = nil
+	mc.index = -1
+	*q = old[:len(old)-1]
+	return mc
+}
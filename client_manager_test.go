@@ -0,0 +1,193 @@
+package configcat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// multiKeyServer serves a different config.json for each SDK key.
+type multiKeyServer struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	bodies   map[string]string
+	requests map[string]int
+}
+
+func newMultiKeyServer(t testing.TB) *multiKeyServer {
+	srv := &multiKeyServer{
+		bodies:   make(map[string]string),
+		requests: make(map[string]int),
+	}
+	srv.srv = httptest.NewServer(srv)
+	t.Cleanup(srv.srv.Close)
+	return srv
+}
+
+func (srv *multiKeyServer) set(sdkKey string, body string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.bodies[sdkKey] = body
+}
+
+func (srv *multiKeyServer) requestCount(sdkKey string) int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.requests[sdkKey]
+}
+
+func (srv *multiKeyServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/configuration-files/")
+	sdkKey := path[:strings.LastIndexByte(path, '/')]
+	srv.mu.Lock()
+	srv.requests[sdkKey]++
+	body, ok := srv.bodies[sdkKey]
+	srv.mu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Write([]byte(body))
+}
+
+func TestClientManager(t *testing.T) {
+	c := qt.New(t)
+	srv := newMultiKeyServer(t)
+	key1, key2 := randomSdkKey(), randomSdkKey()
+	srv.set(key1, marshalJSON(rootNodeWithKeyValue("key", "value1")))
+	srv.set(key2, marshalJSON(rootNodeWithKeyValue("key", "value2")))
+
+	m := NewClientManager(ClientManagerConfig{
+		Config: Config{
+			BaseURL:      srv.srv.URL,
+			Logger:       newTestLogger(t),
+			LogLevel:     LogLevelError,
+			PollInterval: 20 * time.Millisecond,
+		},
+		Workers: 2,
+	})
+	defer m.Close()
+
+	client1 := m.Get(context.Background(), key1)
+	c.Assert(client1.GetStringValue("key", "", nil), qt.Equals, "value1")
+	client2 := m.Get(context.Background(), key2)
+	c.Assert(client2.GetStringValue("key", "", nil), qt.Equals, "value2")
+	c.Assert(m.Get(context.Background(), key1), qt.Equals, client1)
+	c.Assert(m.Stats().Clients, qt.Equals, 2)
+
+	// The clients are refreshed by the manager.
+	srv.set(key1, marshalJSON(rootNodeWithKeyValue("key", "value1b")))
+	waitFor(t, func() bool {
+		return client1.GetStringValue("key", "", nil) == "value1b"
+	})
+	// The worker counts a refresh only after it returns,
+	// which may be after the client has the new value.
+	waitFor(t, func() bool {
+		return m.Stats().Refreshes >= 3
+	})
+	c.Assert(m.Stats().FailedRefreshes, qt.Equals, uint64(0))
+}
+
+func TestClientManager_IdleEviction(t *testing.T) {
+	c := qt.New(t)
+	srv := newMultiKeyServer(t)
+	key := randomSdkKey()
+	srv.set(key, marshalJSON(rootNodeWithKeyValue("key", "value")))
+
+	m := NewClientManager(ClientManagerConfig{
+		Config: Config{
+			BaseURL:      srv.srv.URL,
+			Logger:       newTestLogger(t),
+			LogLevel:     LogLevelError,
+			PollInterval: 10 * time.Millisecond,
+		},
+		IdleTTL: 30 * time.Millisecond,
+	})
+	defer m.Close()
+
+	client := m.Get(context.Background(), key)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value")
+	waitFor(t, func() bool {
+		return m.Stats().Evictions == 1
+	})
+	c.Assert(m.Stats().Clients, qt.Equals, 0)
+	requests := srv.requestCount(key)
+	time.Sleep(30 * time.Millisecond)
+	c.Assert(srv.requestCount(key), qt.Equals, requests)
+
+	// A new client is created on demand.
+	c.Assert(m.Get(context.Background(), key), qt.Not(qt.Equals), client)
+	c.Assert(m.Stats().Clients, qt.Equals, 1)
+}
+
+func TestClientManager_FailedRefresh(t *testing.T) {
+	c := qt.New(t)
+	srv := newMultiKeyServer(t)
+	m := NewClientManager(ClientManagerConfig{
+		Config: Config{
+			BaseURL:      srv.srv.URL,
+			Logger:       newTestLogger(t),
+			LogLevel:     LogLevelNone,
+			PollInterval: time.Hour,
+		},
+	})
+	defer m.Close()
+
+	client := m.Get(context.Background(), randomSdkKey())
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "default")
+	c.Assert(m.Stats().FailedRefreshes, qt.Equals, uint64(1))
+}
+
+func TestClientManager_ConcurrentGet(t *testing.T) {
+	c := qt.New(t)
+	srv := newMultiKeyServer(t)
+	key := randomSdkKey()
+	srv.set(key, marshalJSON(rootNodeWithKeyValue("key", "value")))
+	m := NewClientManager(ClientManagerConfig{
+		Config: Config{
+			BaseURL:      srv.srv.URL,
+			Logger:       newTestLogger(t),
+			LogLevel:     LogLevelError,
+			PollInterval: time.Hour,
+		},
+	})
+	defer m.Close()
+
+	clients := make(chan *Client, 10)
+	for i := 0; i < cap(clients); i++ {
+		go func() {
+			clients <- m.Get(context.Background(), key)
+		}()
+	}
+	client := <-clients
+	for i := 1; i < cap(clients); i++ {
+		c.Assert(<-clients, qt.Equals, client)
+	}
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value")
+	c.Assert(srv.requestCount(key), qt.Equals, 1)
+}
+
+func TestClientManager_Closed(t *testing.T) {
+	c := qt.New(t)
+	srv := newMultiKeyServer(t)
+	key := randomSdkKey()
+	srv.set(key, marshalJSON(rootNodeWithKeyValue("key", "value")))
+	m := NewClientManager(ClientManagerConfig{
+		Config: Config{
+			BaseURL:  srv.srv.URL,
+			Logger:   newTestLogger(t),
+			LogLevel: LogLevelError,
+		},
+	})
+	c.Assert(m.Get(context.Background(), key), qt.Not(qt.IsNil))
+	m.Close()
+	c.Assert(m.Get(context.Background(), key), qt.IsNil)
+	c.Assert(m.Stats().Clients, qt.Equals, 0)
+}
@@ -0,0 +1,161 @@
+package configcat
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// ConfigChange describes the differences between the settings of
+// two configurations. Each list is sorted by key.
+type ConfigChange struct {
+	// Added holds the settings that are only in the new configuration.
+	Added []SettingChange
+	// Removed holds the settings that are only in the old configuration.
+	Removed []SettingChange
+	// Modified holds the settings that are in both configurations
+	// but differ in type, default value or targeting.
+	Modified []SettingChange
+}
+
+// SettingChange describes how a setting differs between two configurations.
+type SettingChange struct {
+	// Key holds the key of the setting.
+	Key string
+	// OldValue holds the default value of the setting in the old
+	// configuration, or nil if the setting has been added.
+	OldValue interface{}
+	// NewValue holds the default value of the setting in the new
+	// configuration, or nil if the setting has been removed.
+	NewValue interface{}
+	// TargetingChanged reports whether the targeting rules or the
+	// percentage options of a modified setting have changed,
+	// including the segments and the prerequisite flags its
+	// targeting rules refer to.
+	TargetingChanged bool
+}
+
+// IsEmpty reports whether no setting has changed.
+func (c *ConfigChange) IsEmpty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0
+}
+
+// diffConfigs returns the differences between the settings of
+// oldRoot and newRoot, either of which may be nil.
+func diffConfigs(oldRoot, newRoot *ConfigJson) *ConfigChange {
+	var oldSettings, newSettings map[string]*Setting
+	if oldRoot != nil {
+		oldSettings = oldRoot.Settings
+	}
+	if newRoot != nil {
+		newSettings = newRoot.Settings
+	}
+	change := &ConfigChange{}
+	for key, newSetting := range newSettings {
+		oldSetting, ok := oldSettings[key]
+		if !ok {
+			change.Added = append(change.Added, SettingChange{
+				Key:      key,
+				NewValue: defaultValueOf(newSetting),
+			})
+			continue
+		}
+		targetingChanged := !bytes.Equal(targetingFingerprint(oldSetting, oldSettings), targetingFingerprint(newSetting, newSettings))
+		oldValue, newValue := defaultValueOf(oldSetting), defaultValueOf(newSetting)
+		if targetingChanged || oldSetting.Type != newSetting.Type || !reflect.DeepEqual(oldValue, newValue) {
+			change.Modified = append(change.Modified, SettingChange{
+				Key:              key,
+				OldValue:         oldValue,
+				NewValue:         newValue,
+				TargetingChanged: targetingChanged,
+			})
+		}
+	}
+	for key, oldSetting := range oldSettings {
+		if _, ok := newSettings[key]; !ok {
+			change.Removed = append(change.Removed, SettingChange{
+				Key:      key,
+				OldValue: defaultValueOf(oldSetting),
+			})
+		}
+	}
+	for _, changes := range [][]SettingChange{change.Added, change.Removed, change.Modified} {
+		sort.Slice(changes, func(i, j int) bool {
+			return changes[i].Key < changes[j].Key
+		})
+	}
+	return change
+}
+
+func defaultValueOf(setting *Setting) interface{} {
+	if setting == nil || setting.Value == nil {
+		return nil
+	}
+	return setting.Value.Value
+}
+
+// targetingFingerprint returns an encoding of everything that
+// determines how a setting is targeted, including the contents of
+// the segments its targeting rules refer to and the prerequisite
+// flags they depend on, which are looked up in settings.
+func targetingFingerprint(setting *Setting, settings map[string]*Setting) []byte {
+	data, err := json.Marshal(targetingOf(setting, settings, map[string]bool{}))
+	if err != nil {
+		// Can't happen with a parsed configuration, but
+		// err on the side of reporting a change.
+		return []byte(err.Error())
+	}
+	return data
+}
+
+// settingTargeting holds what's encoded by targetingFingerprint.
+type settingTargeting struct {
+	Attribute         string
+	TargetingRules    []*TargetingRule
+	PercentageOptions []*PercentageOption
+	Segments          []*Segment
+	Prerequisites     map[string]*prerequisiteTargeting `json:",omitempty"`
+}
+
+// prerequisiteTargeting holds what determines the
+// value of a prerequisite flag.
+type prerequisiteTargeting struct {
+	Type      SettingType
+	Value     interface{}
+	Targeting *settingTargeting
+}
+
+// targetingOf returns the targeting of setting. The visited map
+// holds the prerequisite flags already included, which guards
+// against circular dependencies.
+func targetingOf(setting *Setting, settings map[string]*Setting, visited map[string]bool) *settingTargeting {
+	t := &settingTargeting{
+		Attribute:         setting.PercentageOptionsAttribute,
+		TargetingRules:    setting.TargetingRules,
+		PercentageOptions: setting.PercentageOptions,
+	}
+	for _, rule := range setting.TargetingRules {
+		for _, cond := range rule.Conditions {
+			if cond.SegmentCondition != nil {
+				t.Segments = append(t.Segments, cond.SegmentCondition.relatedSegment)
+			}
+			prerequisite := cond.PrerequisiteFlagCondition
+			if prerequisite == nil || visited[prerequisite.FlagKey] {
+				continue
+			}
+			visited[prerequisite.FlagKey] = true
+			if t.Prerequisites == nil {
+				t.Prerequisites = make(map[string]*prerequisiteTargeting)
+			}
+			p := &prerequisiteTargeting{}
+			if prerequisiteSetting := settings[prerequisite.FlagKey]; prerequisiteSetting != nil {
+				p.Type = prerequisiteSetting.Type
+				p.Value = defaultValueOf(prerequisiteSetting)
+				p.Targeting = targetingOf(prerequisiteSetting, settings, visited)
+			}
+			t.Prerequisites[prerequisite.FlagKey] = p
+		}
+	}
+	return t
+}
@@ -0,0 +1,137 @@
+package configcat
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	c := qt.New(t)
+	oldRoot := parseConfigJSON(c, `{
+		"s": [{"n": "Beta", "r": [{"a": "Email", "c": 2, "l": ["@example.com"]}]}],
+		"f": {
+			"same": {"t": 1, "v": {"s": "x"}},
+			"removed": {"t": 0, "v": {"b": true}},
+			"value": {"t": 2, "v": {"i": 1}},
+			"rules": {"t": 0, "v": {"b": false}, "r": [{"c": [{"u": {"a": "Country", "c": 0, "l": ["US"]}}], "s": {"v": {"b": true}}}]},
+			"segment": {"t": 0, "v": {"b": false}, "r": [{"c": [{"s": {"s": 0, "c": 0}}], "s": {"v": {"b": true}}}]},
+			"percentage": {"t": 0, "v": {"b": false}, "p": [{"p": 50, "v": {"b": true}}, {"p": 50, "v": {"b": false}}]}
+		}
+	}`)
+	newRoot := parseConfigJSON(c, `{
+		"s": [{"n": "Beta", "r": [{"a": "Email", "c": 2, "l": ["@example.org"]}]}],
+		"f": {
+			"same": {"t": 1, "v": {"s": "x"}},
+			"added": {"t": 1, "v": {"s": "new"}},
+			"value": {"t": 2, "v": {"i": 2}},
+			"rules": {"t": 0, "v": {"b": false}, "r": [{"c": [{"u": {"a": "Country", "c": 0, "l": ["US", "CA"]}}], "s": {"v": {"b": true}}}]},
+			"segment": {"t": 0, "v": {"b": false}, "r": [{"c": [{"s": {"s": 0, "c": 0}}], "s": {"v": {"b": true}}}]},
+			"percentage": {"t": 0, "v": {"b": false}, "p": [{"p": 20, "v": {"b": true}}, {"p": 80, "v": {"b": false}}]}
+		}
+	}`)
+	c.Assert(diffConfigs(oldRoot, newRoot), qt.DeepEquals, &ConfigChange{
+		Added: []SettingChange{{
+			Key:      "added",
+			NewValue: "new",
+		}},
+		Removed: []SettingChange{{
+			Key:      "removed",
+			OldValue: true,
+		}},
+		Modified: []SettingChange{{
+			Key:              "percentage",
+			OldValue:         false,
+			NewValue:         false,
+			TargetingChanged: true,
+		}, {
+			Key:              "rules",
+			OldValue:         false,
+			NewValue:         false,
+			TargetingChanged: true,
+		}, {
+			Key:              "segment",
+			OldValue:         false,
+			NewValue:         false,
+			TargetingChanged: true,
+		}, {
+			Key:      "value",
+			OldValue: 1,
+			NewValue: 2,
+		}},
+	})
+	c.Assert(diffConfigs(oldRoot, oldRoot).IsEmpty(), qt.IsTrue)
+	c.Assert(diffConfigs(nil, oldRoot).Added, qt.HasLen, 6)
+}
+
+func TestDiffConfigs_PrerequisiteFlag(t *testing.T) {
+	c := qt.New(t)
+	oldRoot := parseConfigJSON(c, `{
+		"f": {
+			"base": {"t": 0, "v": {"b": false}},
+			"dependent": {"t": 0, "v": {"b": false}, "r": [{"c": [{"p": {"f": "base", "c": 0, "v": {"b": true}}}], "s": {"v": {"b": true}}}]}
+		}
+	}`)
+	newRoot := parseConfigJSON(c, `{
+		"f": {
+			"base": {"t": 0, "v": {"b": true}},
+			"dependent": {"t": 0, "v": {"b": false}, "r": [{"c": [{"p": {"f": "base", "c": 0, "v": {"b": true}}}], "s": {"v": {"b": true}}}]}
+		}
+	}`)
+	// The targeting of the dependent flag is unchanged,
+	// but it evaluates differently all the same.
+	c.Assert(diffConfigs(oldRoot, newRoot), qt.DeepEquals, &ConfigChange{
+		Modified: []SettingChange{{
+			Key:      "base",
+			OldValue: false,
+			NewValue: true,
+		}, {
+			Key:              "dependent",
+			OldValue:         false,
+			NewValue:         false,
+			TargetingChanged: true,
+		}},
+	})
+}
+
+func TestClient_OnConfigChangedWithDiff(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value1"))
+	changes := make(chan *ConfigChange, 1)
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Hooks = &Hooks{OnConfigChangedWithDiff: func(change *ConfigChange) { changes <- change }}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(receiveChange(t, changes), qt.DeepEquals, &ConfigChange{
+		Added: []SettingChange{{Key: "key", NewValue: "value1"}},
+	})
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(receiveChange(t, changes), qt.DeepEquals, &ConfigChange{
+		Modified: []SettingChange{{Key: "key", OldValue: "value1", NewValue: "value2"}},
+	})
+}
+
+func receiveChange(t *testing.T, changes <-chan *ConfigChange) *ConfigChange {
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for OnConfigChangedWithDiff")
+		return nil
+	}
+}
+
+func parseConfigJSON(c *qt.C, s string) *ConfigJson {
+	var root ConfigJson
+	c.Assert(json.Unmarshal([]byte(s), &root), qt.IsNil)
+	fixupSegmentsAndSalt(&root)
+	return &root
+}
@@ -2,6 +2,8 @@ package configcat
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/configcat/go-sdk/v9/configcatcache"
@@ -16,11 +18,31 @@ import (
 const (
 	globalBaseURL = "https://cdn-global.configcat.com"
 	euOnlyBaseURL = "https://cdn-eu.configcat.com"
+
+	// minEndpointCooldown and preferredEndpointRetryInterval bound
+	// how long a base URL is avoided after failing: the cooldown
+	// starts at the former and doubles with each consecutive failure
+	// up to the latter. The fetcher keeps using a fallback base URL
+	// until the preferred one has cooled down.
+	minEndpointCooldown            = 15 * time.Second
+	preferredEndpointRetryInterval = 5 * time.Minute
+
+	// maxCacheWriteAttempts holds how many times the fetcher tries
+	// to write a cache entry that keeps being changed by others.
+	maxCacheWriteAttempts = 3
 )
 
 type fetcherError struct {
 	Err     error
 	EventId int
+
+	// statusCode holds the HTTP status code of
+	// the response that caused the error, if any.
+	statusCode int
+
+	// retryAfter holds the delay requested by the
+	// server through the Retry-After header, if any.
+	retryAfter time.Duration
 }
 
 func (f *fetcherError) Error() string {
@@ -32,32 +54,83 @@ type fetcher interface {
 	close()
 	current() *config
 	isOffline() bool
+	isStreaming() bool
 	setMode(offline bool)
+	requestProbe() bool
 	context() context.Context
 	doneInitGet() chan struct{}
+	stats() ClientStats
+	shutdown(ctx context.Context) error
 }
 
 type configFetcher struct {
 	sdkKey            string
 	cacheKey          string
 	cache             ConfigCache
+	cacheExt          ConfigCacheExt // set when cache implements ConfigCacheExt
+	cacheTTL          time.Duration
+	checksummedCache  bool
 	logger            *leveledLogger
 	client            *http.Client
+	streamClient      *http.Client
 	urlIsCustom       bool
 	changeNotify      func()
 	defaultUser       User
 	pollingIdentifier string
 	overrides         *FlagOverrides
 	hooks             *Hooks
-	offline           uint32
+	offline           uint32 // modeOnline, modeOffline or modeAutoOffline
+	streaming         uint32 // set atomically while the config stream is connected
 	timeout           time.Duration
+	retryPolicy       *RetryPolicy
+	source            ConfigSource
+
+	// pollInterval holds the poll interval in use.
+	// It's only changed by reconfigure.
+	pollInterval time.Duration
+
+	fetchStats fetchStats
+
+	// autoOffline is set when the fetcher switches offline by itself.
+	// networkFailures and lastProbe are only used by the fetcher goroutine.
+	// probeRequested is set atomically by requestProbe.
+	autoOffline     *AutoOfflinePolicy
+	networkFailures int
+	lastProbe       time.Time
+	probeRequested  uint32
+
+	// locker is set when the cache implements ConfigCacheLocker.
+	// lockHeld is guarded by mu, as are lockKey and lockTTL when
+	// read from outside the fetcher goroutine.
+	locker    ConfigCacheLocker
+	lockKey   string
+	lockOwner string
+	lockTTL   time.Duration
+	lockHeld  bool
 
 	ctx       context.Context
 	ctxCancel func()
 
-	// baseURL is maintained by the fetcher goroutine.
+	// pollCancel stops the poller or streamer without canceling
+	// any fetch in progress, and pollDone is closed once it has
+	// stopped. They're guarded by mu and nil when there's none.
+	pollCancel func()
+	pollDone   chan struct{}
+
+	// baseURL holds the base URL currently in use.
+	// It is maintained by the fetcher goroutine and
+	// guarded by mu when read from elsewhere.
 	baseURL string
 
+	// endpoints holds the configured base URLs in order of
+	// preference and endpointIndex the index of the one in use.
+	// They are only used by the fetcher goroutine, except that
+	// reconfigure replaces them with mu held while no fetch is
+	// in progress.
+	endpoints              []*endpoint
+	endpointIndex          int
+	preferredRetryInterval time.Duration
+
 	// wg counts the number of outstanding goroutines
 	// so that we can wait for them to finish when closed.
 	wg sync.WaitGroup
@@ -68,21 +141,68 @@ type configFetcher struct {
 	doneInitialGet chan struct{}
 	doneGetOnce    sync.Once
 
-	mu        sync.Mutex
-	config    atomic.Value // holds *config or nil.
-	fetchDone chan error
+	mu       sync.Mutex
+	config   atomic.Value // holds *config or nil.
+	inflight *inflightFetch
+
+	// approveMu is held while the OnBeforeConfigApply hook is called.
+	approveMu sync.Mutex
+
+	// cacheEntry holds the cache entry last read or written, if
+	// any, so that saveToCache needn't read the cache again first.
+	cacheEntry []byte
+
+	// closed is set when the fetcher has been shut down.
+	closed bool
+}
+
+// inflightFetch holds the state of a fetch in progress.
+// Its fields other than done are guarded by configFetcher.mu.
+type inflightFetch struct {
+	// done receives the result of the fetch.
+	done chan error
+
+	// ctx is canceled to abort the fetch.
+	ctx    context.Context
+	cancel func()
+
+	// waiters holds the number of callers waiting
+	// for the result of the fetch.
+	waiters int
+
+	// detached is set when the fetch must run to completion
+	// even if no caller is waiting for its result.
+	detached bool
+
+	// canceled is set when the fetch is canceled because
+	// every caller waiting for its result has given up.
+	// Note: ctx is also canceled once the fetch is done.
+	canceled bool
+
+	// cacheBefore holds the fetch time before which
+	// a cached configuration isn't used without fetching.
+	cacheBefore time.Time
+
+	// approving is set while the OnBeforeConfigApply hook
+	// examines the fetched configuration.
+	approving bool
 }
 
 // newConfigFetcher returns a
 func newConfigFetcher(cfg Config, logger *leveledLogger, defaultUser User) fetcher {
 	f := &configFetcher{
-		sdkKey:    cfg.SDKKey,
-		cache:     cfg.Cache,
-		cacheKey:  configcatcache.ProduceCacheKey(cfg.SDKKey, configcatcache.ConfigJSONName, configcatcache.ConfigJSONCacheVersion),
-		overrides: cfg.FlagOverrides,
-		hooks:     cfg.Hooks,
-		logger:    logger,
-		timeout:   cfg.HTTPTimeout,
+		sdkKey:           cfg.SDKKey,
+		cache:            cfg.Cache,
+		cacheTTL:         cfg.CacheTTL,
+		checksummedCache: cfg.ChecksummedCacheFormat,
+		cacheKey:         configcatcache.ProduceCacheKey(cfg.SDKKey, configcatcache.ConfigJSONName, configcatcache.ConfigJSONCacheVersion),
+		overrides:        cfg.FlagOverrides,
+		hooks:            cfg.Hooks,
+		logger:           logger,
+		timeout:          cfg.HTTPTimeout,
+		source:           cfg.Source,
+		pollInterval:     cfg.PollInterval,
+		autoOffline:      cfg.AutoOffline,
 		client: &http.Client{
 			Timeout:   cfg.HTTPTimeout,
 			Transport: cfg.Transport,
@@ -91,44 +211,158 @@ func newConfigFetcher(cfg Config, logger *leveledLogger, defaultUser User) fetch
 		defaultUser:       defaultUser,
 		pollingIdentifier: pollingModeToIdentifier(cfg.PollingMode),
 	}
+	if f.retryPolicy = cfg.RetryPolicy; f.retryPolicy == nil {
+		f.retryPolicy = defaultRetryPolicy
+	}
 	f.ctx, f.ctxCancel = context.WithCancel(context.Background())
-	if cfg.Offline {
-		f.offline = 1
+	f.cacheExt, _ = cfg.Cache.(ConfigCacheExt)
+	if cfg.CacheTTL > 0 && cfg.Cache != nil && f.cacheExt == nil {
+		logger.Warnf(0, "CacheTTL is ignored because the cache doesn't implement ConfigCacheExt")
 	}
-	if cfg.BaseURL == "" {
-		if cfg.DataGovernance == Global {
-			f.baseURL = globalBaseURL
-		} else {
-			f.baseURL = euOnlyBaseURL
-		}
-	} else {
-		f.urlIsCustom = true
-		f.baseURL = cfg.BaseURL
+	if locker, ok := cfg.Cache.(ConfigCacheLocker); ok {
+		var owner [8]byte
+		rand.Read(owner[:])
+		f.locker = locker
+		f.lockKey = f.cacheKey + "_lock"
+		f.lockOwner = hex.EncodeToString(owner[:])
+		f.lockTTL = 2 * cfg.PollInterval
 	}
-	if cfg.PollingMode == AutoPoll {
+	if cfg.Offline {
+		f.offline = modeOffline
+	}
+	f.endpoints, f.urlIsCustom = newEndpoints(cfg)
+	f.baseURL = f.endpoints[0].current
+	f.preferredRetryInterval = preferredEndpointRetryInterval
+	switch cfg.PollingMode {
+	case AutoPoll, Streaming:
 		// Start a fetcher goroutine immediately
 		// to avoid a potential double fetch
 		// when someone calls Refresh immediately
 		// after creating the client.
-		_ = f.refreshIfOlder(f.ctx, time.Time{}, false)
-		f.wg.Add(1)
-		go f.runPoller(cfg.PollInterval)
+		before := time.Time{}
+		if cfg.StartFromCache && f.startFromCache() {
+			// Refresh even though there's a current configuration,
+			// unless the cached one is recent enough.
+			before = time.Now().Add(1)
+		}
+		_ = f.refresh(f.ctx, before, time.Now().Add(-cfg.PollInterval), false)
+		f.startPoller(cfg.PollingMode, cfg.PollInterval)
 	}
 	return f
 }
 
+// newEndpoints returns the endpoints for the base URLs of cfg
+// and whether they're custom rather than chosen from the
+// data governance.
+func newEndpoints(cfg Config) (endpoints []*endpoint, urlIsCustom bool) {
+	switch {
+	case len(cfg.BaseURLs) > 0:
+		urlIsCustom = true
+		for _, u := range cfg.BaseURLs {
+			endpoints = append(endpoints, &endpoint{url: u})
+		}
+	case cfg.BaseURL != "":
+		urlIsCustom = true
+		endpoints = []*endpoint{{url: cfg.BaseURL}}
+	case cfg.DataGovernance == Global:
+		endpoints = []*endpoint{{url: globalBaseURL}}
+	default:
+		endpoints = []*endpoint{{url: euOnlyBaseURL}}
+	}
+	for _, ep := range endpoints {
+		ep.current = ep.url
+	}
+	return endpoints, urlIsCustom
+}
+
+// startPoller starts the poller or, in Streaming mode, the streamer
+// if the given polling mode needs one and the fetcher isn't closed.
+func (f *configFetcher) startPoller(mode PollingMode, pollInterval time.Duration) {
+	if mode != AutoPoll && mode != Streaming {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	ctx, cancel := context.WithCancel(f.ctx)
+	done := make(chan struct{})
+	f.pollCancel, f.pollDone = cancel, done
+	f.wg.Add(1)
+	if mode == Streaming && f.source == nil {
+		if f.streamClient == nil {
+			f.streamClient = &http.Client{
+				// Note: no Timeout here because it would
+				// apply to reading the whole (endless) response body.
+				Transport: f.client.Transport,
+			}
+		}
+		go f.runStreamer(ctx, done, pollInterval)
+	} else {
+		go f.runPoller(ctx, done, pollInterval)
+	}
+}
+
+// stopPoller stops the poller or streamer, if any, and waits
+// for it to finish. It returns early with the context's
+// error if ctx is done first.
+func (f *configFetcher) stopPoller(ctx context.Context) error {
+	f.mu.Lock()
+	cancel, done := f.pollCancel, f.pollDone
+	f.pollCancel, f.pollDone = nil, nil
+	f.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// startFromCache makes the configuration in the cache, if any,
+// the current one and marks the initial get as done.
+// It reports whether a configuration was found.
+func (f *configFetcher) startFromCache() bool {
+	cached := f.readCache(f.ctx, nil)
+	if cached == nil || f.approve(cached, nil) != nil {
+		return false
+	}
+	f.mu.Lock()
+	f.apply(cached, nil)
+	f.mu.Unlock()
+	f.doneGetOnce.Do(func() {
+		close(f.doneInitialGet)
+	})
+	return true
+}
+
 func (f *configFetcher) isOffline() bool {
-	return atomic.LoadUint32(&f.offline) == 1
+	return atomic.LoadUint32(&f.offline) != modeOnline
+}
+
+// isStreaming reports whether the config stream is connected, in which
+// case the current configuration is up to date whatever its fetch time.
+func (f *configFetcher) isStreaming() bool {
+	return atomic.LoadUint32(&f.streaming) == 1
 }
 
 func (f *configFetcher) setMode(offline bool) {
+	var prev uint32
 	if offline {
-		atomic.StoreUint32(&f.offline, 1)
+		prev = atomic.SwapUint32(&f.offline, modeOffline)
 		f.logger.Infof(5200, "switched to OFFLINE mode")
 	} else {
-		atomic.StoreUint32(&f.offline, 0)
+		prev = atomic.SwapUint32(&f.offline, modeOnline)
 		f.logger.Infof(5200, "switched to ONLINE mode")
 	}
+	if (prev != modeOnline) != offline {
+		f.stateChanged(offline)
+	}
 }
 
 func (f *configFetcher) context() context.Context {
@@ -139,22 +373,103 @@ func (f *configFetcher) doneInitGet() chan struct{} {
 	return f.doneInitialGet
 }
 
+func (f *configFetcher) stats() ClientStats {
+	var stats ClientStats
+	f.fetchStats.fill(&stats)
+	cfg := f.current()
+	switch {
+	case f.overrides != nil && f.overrides.Behavior == LocalOnly:
+		stats.ConfigOrigin = ConfigOriginOverrides
+	case cfg == nil:
+		stats.ConfigOrigin = ConfigOriginNone
+	case cfg.fromCache:
+		stats.ConfigOrigin = ConfigOriginCache
+	default:
+		stats.ConfigOrigin = ConfigOriginHTTP
+	}
+	if cfg != nil {
+		stats.ConfigFetchTime = cfg.fetchTime
+	}
+	if f.source == nil {
+		f.mu.Lock()
+		stats.BaseURL = f.baseURL
+		f.mu.Unlock()
+	}
+	return stats
+}
+
 func (f *configFetcher) close() {
 	f.ctxCancel()
-	f.wg.Wait()
+	if err := f.shutdown(context.Background()); err != nil {
+		f.logger.Errorf(0, "%v", err)
+	}
+}
+
+// shutdown stops polling, refuses any further refresh and waits
+// for the fetch in progress, if any, to complete. If ctx is done
+// first, it cancels the fetch and returns the context's error.
+func (f *configFetcher) shutdown(ctx context.Context) error {
+	f.mu.Lock()
+	f.closed = true
+	pollCancel := f.pollCancel
+	f.mu.Unlock()
+	if pollCancel != nil {
+		pollCancel()
+	}
+	var err error
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("gave up waiting for the config fetch to complete: %w", ctx.Err())
+		f.ctxCancel()
+		<-done
+	}
+	f.ctxCancel()
+	if f.locker == nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.lockHeld {
+		// Let another instance take over without waiting for the lease to expire.
+		if unlockErr := f.locker.Unlock(context.Background(), f.lockKey, f.lockOwner); unlockErr != nil && err == nil {
+			err = fmt.Errorf("error occurred while releasing the cache lock: %v", unlockErr)
+		}
+		f.lockHeld = false
+	}
+	return err
 }
 
-func (f *configFetcher) runPoller(pollInterval time.Duration) {
+func (f *configFetcher) runPoller(ctx context.Context, done chan struct{}, pollInterval time.Duration) {
 	defer f.wg.Done()
+	defer close(done)
 	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
+	f.pollLoop(ctx, ticker, pollInterval)
+}
+
+// pollLoop polls on every tick until ctx is canceled.
+func (f *configFetcher) pollLoop(ctx context.Context, ticker *time.Ticker, pollInterval time.Duration) {
+	// notBefore holds the time until which the server
+	// asked us not to poll through Retry-After.
+	var notBefore time.Time
 	for {
 		select {
 		case <-ticker.C:
-		case <-f.ctx.Done():
+		case <-ctx.Done():
 			return
 		}
-		_ = f.refreshIfOlder(f.ctx, time.Now().Add(-pollInterval/2), true)
+		if time.Now().Before(notBefore) {
+			continue
+		}
+		if delay := retryAfter(f.poll(pollInterval, true)); delay > 0 {
+			notBefore = time.Now().Add(delay)
+		}
 	}
 }
 
@@ -164,129 +479,392 @@ func (f *configFetcher) current() *config {
 	return cfg
 }
 
+// poll refreshes the configuration on behalf of a poller that
+// runs every pollInterval. A configuration written to the cache
+// less than pollInterval ago is used without fetching.
+func (f *configFetcher) poll(pollInterval time.Duration, wait bool) error {
+	now := time.Now()
+	return f.refresh(f.ctx, now.Add(-pollInterval/2), now.Add(-pollInterval), wait)
+}
+
 // refreshIfOlder refreshes the configuration if it was retrieved
-// before the given time or if there is no current configuration. If the context is
-// canceled while the refresh is in progress, Refresh will return but
-// the underlying HTTP request will not be stopped.
+// before the given time or if there is no current configuration.
+// Concurrent calls share a single underlying fetch.
+//
+// If the context is canceled while the refresh is in progress,
+// refreshIfOlder returns immediately. The underlying HTTP request is
+// canceled too once every caller waiting for it has given up, unless
+// it was started by a caller that didn't wait.
 //
 // If wait is false, refreshIfOlder returns immediately without waiting
 // for the refresh to complete.
 func (f *configFetcher) refreshIfOlder(ctx context.Context, before time.Time, wait bool) error {
+	return f.refresh(ctx, before, before, wait)
+}
+
+// refresh is like refreshIfOlder except that a configuration in
+// the cache that was fetched at or after cacheBefore (for example by
+// another instance sharing the cache) is used without fetching.
+func (f *configFetcher) refresh(ctx context.Context, before, cacheBefore time.Time, wait bool) error {
 	f.mu.Lock()
-	prevConfig := f.current()
-	if prevConfig != nil && !prevConfig.fetchTime.Before(before) {
+	for {
+		if f.closed {
+			f.mu.Unlock()
+			return ErrClientClosed
+		}
+		prevConfig := f.current()
+		if prevConfig != nil && !prevConfig.fetchTime.Before(before) {
+			f.mu.Unlock()
+			return nil
+		}
+		fetch := f.inflight
+		if fetch != nil && fetch.approving {
+			// The fetch is as good as done, and waiting for it would
+			// deadlock when called from the OnBeforeConfigApply hook.
+			f.mu.Unlock()
+			return nil
+		}
+		if fetch == nil {
+			fetch = &inflightFetch{
+				done:        make(chan error, 1),
+				cacheBefore: cacheBefore,
+			}
+			fetch.ctx, fetch.cancel = context.WithCancel(f.ctx)
+			f.inflight = fetch
+			f.wg.Add(1)
+			go f.fetcher(fetch, prevConfig)
+		}
+		// When everyone who was waiting for the fetch in progress has
+		// given up, it's being canceled; when it accepts older cached
+		// configurations than we do, its result may not do for us. Either
+		// way, we may need to start another fetch once it's done.
+		retry := fetch.canceled || fetch.cacheBefore.Before(cacheBefore)
+		if !wait {
+			if retry {
+				f.wg.Add(1)
+				go func() {
+					defer f.wg.Done()
+					_ = f.refresh(f.ctx, before, cacheBefore, true)
+				}()
+			} else {
+				fetch.detached = true
+			}
+			f.mu.Unlock()
+			return nil
+		}
+		canceled := fetch.canceled
+		if !canceled {
+			fetch.waiters++
+		}
 		f.mu.Unlock()
-		return nil
-	}
-	fetchDone := f.fetchDone
-	if fetchDone == nil {
-		fetchDone = make(chan error, 1)
-		f.fetchDone = fetchDone
-		f.wg.Add(1)
-		go f.fetcher(prevConfig)
-	}
-	f.mu.Unlock()
-	if !wait {
-		return nil
-	}
-	select {
-	case err := <-fetchDone:
-		// Put the error back in the channel so that other
-		// concurrent refresh calls can have access to it.
-		fetchDone <- err
-		return err
-	case <-ctx.Done():
-		return ctx.Err()
+		select {
+		case err := <-fetch.done:
+			// Put the error back in the channel so that other
+			// concurrent refresh calls can have access to it.
+			fetch.done <- err
+			if !retry || err != nil && !canceled {
+				return err
+			}
+		case <-ctx.Done():
+			f.mu.Lock()
+			if !fetch.canceled {
+				fetch.waiters--
+				if fetch.waiters == 0 && !fetch.detached {
+					fetch.canceled = true
+					fetch.cancel()
+				}
+			}
+			f.mu.Unlock()
+			return ctx.Err()
+		}
+		f.mu.Lock()
 	}
 }
 
 // fetcher fetches the latest available configuration, updates f.config and possibly
-// f.baseURL, and sends the result on fetchDone.
+// f.baseURL, and sends the result on fetch.done.
 //
 // Note: although this is started asynchronously, the configFetcher
 // logic guarantees that there's never more than one goroutine
 // at a time running f.fetcher.
-func (f *configFetcher) fetcher(prevConfig *config) {
+func (f *configFetcher) fetcher(fetch *inflightFetch, prevConfig *config) {
 	defer f.wg.Done()
-	config, newURL, err := f.fetchConfig(f.ctx, f.baseURL, prevConfig)
+	defer fetch.cancel()
+	config, err := f.fetchConfig(fetch.ctx, prevConfig, fetch.cacheBefore)
+	var rejectErr error
+	if err == nil && config != nil && f.needsApproval(config, prevConfig) {
+		f.mu.Lock()
+		fetch.approving = true
+		f.mu.Unlock()
+		rejectErr = f.approve(config, prevConfig)
+	}
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	if err != nil {
+	f.baseURL = f.endpoints[f.endpointIndex].current
+	if err != nil && fetch.canceled && f.ctx.Err() == nil {
+		// Everyone waiting for the result has gone away.
+		f.logger.Debugf("config fetch canceled: %v", err)
+		err = fmt.Errorf("config fetch canceled: %v", err)
+	} else if err != nil {
 		var fErr *fetcherError
 		if errors.As(err, &fErr) {
 			f.logger.Errorf(fErr.EventId, "config fetch failed: %v", fErr.Err)
 		} else {
 			f.logger.Errorf(0, "config fetch failed: %v", err)
 		}
-		err = fmt.Errorf("config fetch failed: %v", err)
+		err = fmt.Errorf("config fetch failed: %w", err)
+	} else if f.current() != prevConfig {
+		// A configuration pushed over the stream while we were
+		// fetching is at least as recent as the one we fetched.
+		f.logger.Debugf("discarding the fetched config; a more recent one has been applied in the meantime")
+	} else if rejectErr != nil {
+		err = fmt.Errorf("config fetch failed: %v", rejectErr)
+		f.keep(prevConfig)
 	} else if config != nil && !config.equal(prevConfig) {
-		f.baseURL = newURL
-		f.config.Store(config)
-		if err := f.saveToCache(f.ctx, config.fetchTime, config.etag, config.jsonBody); err != nil {
-			f.logger.Errorf(2201, "error occurred while writing the cache: %v", err)
-		}
-		contentEquals := config.equalContent(prevConfig)
-		if f.hooks != nil && f.hooks.OnConfigChanged != nil && !contentEquals {
-			go f.hooks.OnConfigChanged()
-		}
+		f.apply(config, prevConfig)
 	}
 	// Unblock any Client.getValue call that's waiting for the first configuration to be retrieved.
 	f.doneGetOnce.Do(func() {
 		close(f.doneInitialGet)
 	})
-	f.fetchDone <- err
-	f.fetchDone = nil
+	fetch.done <- err
+	f.inflight = nil
+}
+
+// needsApproval reports whether config must be
+// approved by the OnBeforeConfigApply hook to replace
+// prevConfig as the current configuration.
+func (f *configFetcher) needsApproval(config *config, prevConfig *config) bool {
+	return f.hooks != nil && f.hooks.OnBeforeConfigApply != nil && !config.equalContent(prevConfig)
 }
 
-func (f *configFetcher) fetchConfig(ctx context.Context, baseURL string, prevConfig *config) (_ *config, _newURL string, _err error) {
+// approve calls the OnBeforeConfigApply hook, if config needs
+// approval, and returns an error when the hook rejects config,
+// logging the rejection. It must be called without f.mu held,
+// so that the hook can use the client.
+func (f *configFetcher) approve(config *config, prevConfig *config) error {
+	if !f.needsApproval(config, prevConfig) {
+		return nil
+	}
+	var prevRoot *ConfigJson
+	if prevConfig != nil {
+		prevRoot = prevConfig.root
+	}
+	f.approveMu.Lock()
+	err := f.hooks.OnBeforeConfigApply(prevRoot, config.root)
+	f.approveMu.Unlock()
+	if err != nil {
+		f.logger.Errorf(0, "new config rejected by the OnBeforeConfigApply hook: %v", err)
+		return fmt.Errorf("new config rejected: %w", err)
+	}
+	return nil
+}
+
+// keep keeps prevConfig in use after a newer configuration
+// has been rejected, recording that it's been checked now so
+// that the rejected configuration isn't fetched again right away.
+//
+// It must be called with f.mu held.
+func (f *configFetcher) keep(prevConfig *config) {
+	if prevConfig != nil {
+		f.config.Store(prevConfig.withFetchTime(time.Now()))
+	}
+}
+
+// apply makes config the current configuration, writes it to
+// the cache unless it came from there and notifies OnConfigChanged
+// of the differences if its content differs from prevConfig.
+// The OnBeforeConfigApply hook must have approved config already.
+//
+// It must be called with f.mu held.
+func (f *configFetcher) apply(config *config, prevConfig *config) {
+	contentEquals := config.equalContent(prevConfig)
+	f.config.Store(config)
+	if !config.fromCache {
+		if err := f.saveToCache(f.ctx, config.fetchTime, config.etag, config.jsonBody); err != nil {
+			f.logger.Errorf(2201, "error occurred while writing the cache: %v", err)
+		}
+	}
+	if hooks := f.hooks; hooks != nil && !contentEquals {
+		hooks.watchers.notify()
+		if hooks.OnConfigChanged != nil {
+			hooks.dispatch(hooks.OnConfigChanged)
+		}
+		if hooks.OnConfigChangedWithDiff != nil {
+			var prevRoot *ConfigJson
+			if prevConfig != nil {
+				prevRoot = prevConfig.root
+			}
+			change := diffConfigs(prevRoot, config.root)
+			hooks.dispatch(func() {
+				hooks.OnConfigChangedWithDiff(change)
+			})
+		}
+	}
+}
+
+func (f *configFetcher) fetchConfig(ctx context.Context, prevConfig *config, cacheBefore time.Time) (*config, error) {
 	if f.overrides != nil && f.overrides.Behavior == LocalOnly {
 		// TODO could potentially refresh f.overrides if it's come from a file.
-		cfg, err := parseConfig(nil, "", time.Now(), f.logger, f.defaultUser, f.overrides, f.hooks)
-		if err != nil {
-			return nil, "", err
-		}
-		return cfg, "", nil
+		return parseConfig(nil, "", time.Now(), f.logger, f.defaultUser, f.overrides, f.hooks)
 	}
 
-	// If we are in offline mode skip HTTP completely and fall back to cache every time.
-	if f.isOffline() {
+	// If we are in offline mode skip HTTP completely and fall back to cache every time,
+	// except to probe the CDN now and then when we went offline by ourselves.
+	probe := f.probeDue()
+	if f.isOffline() && !probe {
 		if f.cache == nil {
-			return nil, "", &fetcherError{EventId: 0, Err: fmt.Errorf("the SDK is in offline mode and no cache is configured")}
+			return nil, &fetcherError{EventId: 0, Err: fmt.Errorf("the SDK is in offline mode and no cache is configured")}
 		}
 		cfg := f.readCache(ctx, prevConfig)
 		if cfg == nil {
-			return nil, "", &fetcherError{EventId: 0, Err: fmt.Errorf("the SDK is in offline mode and wasn't able to read a valid configuration from the cache")}
+			return nil, &fetcherError{EventId: 0, Err: fmt.Errorf("the SDK is in offline mode and wasn't able to read a valid configuration from the cache")}
+		}
+		return cfg, nil
+	}
+
+	// When instances share the cache, another one may
+	// have fetched a recent enough configuration already.
+	// A probe goes to the CDN regardless.
+	cached := f.readCache(ctx, prevConfig)
+	if !probe && cached != nil && !cached.fetchTime.Before(cacheBefore) {
+		return cached, nil
+	}
+
+	if !probe && !f.isLeader(ctx) {
+		if cached != nil {
+			// The leader is responsible for fetching; use
+			// whatever it has written to the cache.
+			return cached, nil
+		}
+		if prevConfig != nil {
+			return nil, &fetcherError{EventId: 0, Err: fmt.Errorf("another instance holds the cache lock and the cache holds no more recent configuration")}
+		}
+		f.logger.Debugf("no configuration available yet; fetching without holding the cache lock")
+	}
+
+	var cfg *config
+	var err error
+	start := time.Now()
+	if f.source != nil {
+		cfg, err = f.fetchFromSource(ctx, prevConfig)
+	} else {
+		// We are online, use HTTP
+		cfg, err = f.fetchHTTPWithRetry(ctx, prevConfig)
+		if ctx.Err() == nil {
+			f.checkConnectivity(err)
+		}
+	}
+	if ctx.Err() == nil {
+		// Retries, failovers and redirects count as a single fetch.
+		f.fetchStats.record(start, prevConfig, cfg, err)
+		if err == nil {
+			f.renewLock(ctx)
 		}
-		return cfg, baseURL, nil
 	}
+	if err == nil || ctx.Err() != nil || cached == nil {
+		return cfg, err
+	}
+	// Fall back to the cache
+	return cached, nil
+}
 
-	// We are online, use HTTP
-	cfg, newBaseURL, err := f.fetchHTTP(ctx, baseURL, prevConfig)
-	if err == nil {
-		return cfg, newBaseURL, nil
+// isLeader reports whether this instance is responsible for fetching
+// the configuration on behalf of all the instances sharing the cache,
+// acquiring the cache lock as needed. It always reports true when the
+// cache doesn't implement ConfigCacheLocker or the lock can't be
+// acquired because of an error.
+func (f *configFetcher) isLeader(ctx context.Context) bool {
+	if f.locker == nil {
+		return true
+	}
+	f.mu.Lock()
+	held := f.lockHeld
+	f.mu.Unlock()
+	if held {
+		// The lease is only renewed once the fetch has
+		// succeeded (see renewLock).
+		return true
+	}
+	held, err := f.locker.TryLock(ctx, f.lockKey, f.lockOwner, f.lockTTL)
+	if err != nil {
+		f.logger.Errorf(0, "error occurred while acquiring the cache lock: %v", err)
+		return true
+	}
+	f.mu.Lock()
+	f.setLockHeld(held)
+	f.mu.Unlock()
+	return held
+}
+
+// renewLock extends the lease on the cache lock, if it's held, after
+// a successful fetch. An instance that stops fetching, such as an idle
+// one in Lazy or Manual mode, thus lets another one take over once its
+// lease has expired.
+func (f *configFetcher) renewLock(ctx context.Context) {
+	if f.locker == nil {
+		return
+	}
+	f.mu.Lock()
+	held := f.lockHeld
+	f.mu.Unlock()
+	if !held {
+		return
+	}
+	held, err := f.locker.TryLock(ctx, f.lockKey, f.lockOwner, f.lockTTL)
+	if err != nil {
+		f.logger.Errorf(0, "error occurred while renewing the cache lock: %v", err)
+		return
 	}
-	cfg = f.readCache(ctx, prevConfig)
-	if cfg == nil {
-		return nil, "", err
+	f.mu.Lock()
+	f.setLockHeld(held)
+	f.mu.Unlock()
+}
+
+// setLockHeld records whether the cache lock is held.
+// It must be called with f.mu held.
+func (f *configFetcher) setLockHeld(held bool) {
+	if held != f.lockHeld {
+		if held {
+			f.logger.Debugf("acquired the cache lock; fetching on behalf of all instances sharing the cache")
+		} else {
+			f.logger.Debugf("lost the cache lock; reading the configuration from the cache")
+		}
 	}
-	return cfg, baseURL, nil
+	f.lockHeld = held
 }
 
 func (f *configFetcher) readCache(ctx context.Context, prevConfig *config) (_ *config) {
 	if f.cache == nil {
 		return nil
 	}
-	// Fall back to the cache
-	fetchTime, eTag, configBytes, cacheErr := f.parseFromCache(ctx)
+	cacheText, cacheErr := f.cache.Get(ctx, f.cacheKey)
 	if cacheErr != nil {
 		f.logger.Errorf(2200, "error occurred while reading the cache: %v", cacheErr)
 		return nil
 	}
+	if len(cacheText) == 0 {
+		// Nothing has been cached yet.
+		return nil
+	}
+	fetchTime, eTag, configBytes, cacheErr := configcatcache.CacheSegmentsFromBytes(cacheText)
+	if cacheErr != nil {
+		// Note: the entry may have been written by a newer SDK or
+		// another application sharing the cache, so leave it alone.
+		f.logger.Errorf(2200, "error occurred while reading the cache: %v", cacheErr)
+		return nil
+	}
 	cfg, parseErr := parseConfig(configBytes, eTag, fetchTime, f.logger, f.defaultUser, f.overrides, f.hooks)
 	if parseErr != nil {
 		f.logger.Errorf(2200, "error occurred while reading the cache; cache contained invalid config: %v", parseErr)
 		return nil
 	}
+	if f.cacheExt != nil {
+		f.mu.Lock()
+		f.cacheEntry = cacheText
+		f.mu.Unlock()
+	}
+	cfg.fromCache = true
 	if prevConfig == nil || !cfg.fetchTime.Before(prevConfig.fetchTime) {
 		f.logger.Debugf("returning cached config %v", cfg.body())
 		return cfg
@@ -295,22 +873,132 @@ func (f *configFetcher) readCache(ctx context.Context, prevConfig *config) (_ *c
 	return nil
 }
 
-func (f *configFetcher) parseFromCache(ctx context.Context) (fetchTime time.Time, eTag string, config []byte, err error) {
-	cacheText, cacheErr := f.cache.Get(ctx, f.cacheKey)
-	if cacheErr != nil {
-		return time.Time{}, "", nil, cacheErr
+// saveToCache writes the given configuration to the cache.
+// It must be called with f.mu held.
+func (f *configFetcher) saveToCache(ctx context.Context, fetchTime time.Time, eTag string, config []byte) (err error) {
+	if f.cache == nil {
+		return nil
 	}
 
-	return configcatcache.CacheSegmentsFromBytes(cacheText)
+	var toCache []byte
+	if f.checksummedCache {
+		toCache = configcatcache.CacheEntryToBytes(fetchTime, eTag, config)
+	} else {
+		toCache = configcatcache.CacheSegmentsToBytes(fetchTime, eTag, config)
+	}
+	if f.cacheExt == nil {
+		return f.cache.Set(ctx, f.cacheKey, toCache)
+	}
+	// Another instance sharing the cache may write at the same time:
+	// make sure we never replace an entry with an older fetch.
+	for attempt := 0; attempt < maxCacheWriteAttempts; attempt++ {
+		current := f.cacheEntry
+		if attempt > 0 || current == nil {
+			if current, err = f.cacheExt.Get(ctx, f.cacheKey); err != nil {
+				return err
+			}
+		}
+		f.cacheEntry = nil
+		// Replace the current entry, even an invalid one, unless
+		// it holds a more recent fetch or changes meanwhile.
+		if len(current) > 0 {
+			currentFetchTime, _, _, err := configcatcache.CacheSegmentsFromBytes(current)
+			if err == nil && currentFetchTime.After(fetchTime) {
+				f.logger.Debugf("the cache holds a more recent config; not overwriting it")
+				f.cacheEntry = current
+				return nil
+			}
+		}
+		ok, err := f.cacheExt.CompareAndSet(ctx, f.cacheKey, toCache, current, f.cacheTTL)
+		if err != nil {
+			return err
+		}
+		if ok {
+			f.cacheEntry = toCache
+			return nil
+		}
+	}
+	return fmt.Errorf("the cache entry kept changing while it was being written")
 }
 
-func (f *configFetcher) saveToCache(ctx context.Context, fetchTime time.Time, eTag string, config []byte) (err error) {
-	if f.cache == nil {
-		return nil
+// fetchHTTPWithRetry is like fetchHTTP except that it retries
+// transient failures as allowed by f.retryPolicy.
+func (f *configFetcher) fetchHTTPWithRetry(ctx context.Context, prevConfig *config) (*config, error) {
+	for attempt := 1; ; attempt++ {
+		config, err := f.fetchHTTPWithFailover(ctx, prevConfig)
+		if err == nil || attempt >= f.retryPolicy.maxAttempts() {
+			return config, err
+		}
+		delay, ok := f.retryPolicy.delay(attempt, err)
+		if !ok {
+			return nil, err
+		}
+		f.logger.Debugf("config fetch attempt %d failed, retrying in %v: %v", attempt, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
 	}
+}
 
-	toCache := configcatcache.CacheSegmentsToBytes(fetchTime, eTag, config)
-	return f.cache.Set(ctx, f.cacheKey, toCache)
+// fetchHTTPWithFailover is like fetchHTTP except that it tries each
+// configured base URL in turn, starting with the one currently in use,
+// until one of them doesn't fail with a network or server error.
+// Base URLs that failed recently are skipped (see endpoint.coolingDown).
+// The base URL that succeeded stays in use for subsequent fetches,
+// although a preferred one is tried again once it has cooled down.
+func (f *configFetcher) fetchHTTPWithFailover(ctx context.Context, prevConfig *config) (*config, error) {
+	now := time.Now()
+	for i, ep := range f.endpoints[:f.endpointIndex] {
+		if !ep.coolingDown(now, f.preferredRetryInterval) {
+			f.logger.Debugf("trying preferred base URL %v again", ep.url)
+			f.endpointIndex = i
+			break
+		}
+	}
+	var err error
+	for range f.endpoints {
+		ep := f.endpoints[f.endpointIndex]
+		var config *config
+		var newURL string
+		config, newURL, err = f.fetchHTTP(ctx, ep.current, prevConfig)
+		if err == nil {
+			ep.current = newURL
+			ep.consecutiveFailures = 0
+			return config, nil
+		}
+		ep.consecutiveFailures++
+		ep.lastFailure = time.Now()
+		var fErr *fetcherError
+		if len(f.endpoints) == 1 || ctx.Err() != nil || !errors.As(err, &fErr) || !fErr.isTransient() {
+			return nil, err
+		}
+		next := f.nextEndpoint()
+		if next < 0 {
+			f.logger.Debugf("all the other base URLs failed recently; not switching from %v", ep.current)
+			return nil, err
+		}
+		f.logger.Warnf(fErr.EventId, "config fetch from %v failed, switching to %v: %v", ep.current, f.endpoints[next].current, err)
+		f.endpointIndex = next
+	}
+	return nil, err
+}
+
+// nextEndpoint returns the index of the first endpoint after the one in
+// use, in order of preference and wrapping around, that isn't cooling
+// down, or -1 if there's none.
+func (f *configFetcher) nextEndpoint() int {
+	now := time.Now()
+	for i := 1; i < len(f.endpoints); i++ {
+		next := (f.endpointIndex + i) % len(f.endpoints)
+		if !f.endpoints[next].coolingDown(now, f.preferredRetryInterval) {
+			return next
+		}
+	}
+	return -1
 }
 
 // fetchHTTP fetches the configuration while respecting redirects.
@@ -327,51 +1015,62 @@ func (f *configFetcher) fetchHTTP(ctx context.Context, baseURL string, prevConfi
 		if err != nil {
 			return nil, "", err
 		}
-		preferences := config.root.Preferences
-		if preferences == nil ||
-			preferences.Redirect == nil ||
-			preferences.URL == "" ||
-			preferences.URL == baseURL {
-			return config, baseURL, nil
-		}
-		redirect := *preferences.Redirect
-		if redirect == ForceRedirect {
-			f.logger.Debugf("forced redirect to %v (count %d)", preferences.URL, i+1)
-			baseURL = preferences.URL
-			continue
-		}
-		if f.urlIsCustom {
-			if redirect == NoDirect {
-				// The config is available, but we won't respect the redirection
-				// request for a custom URL.
-				f.logger.Debugf("config fetched but refusing to redirect from custom URL without forced redirection")
-				return config, baseURL, nil
-			}
-			// With shouldRedirect, there is no configuration available
-			// other than the redirection information itself, so error.
-			return nil, "", &fetcherError{EventId: 0, Err: fmt.Errorf("refusing to redirect from custom URL without forced redirection")}
+		newBaseURL, useConfig, err := f.redirect(config, baseURL, i+1)
+		if err != nil {
+			return nil, "", err
 		}
-		if preferences.URL == "" {
-			return nil, "", &fetcherError{EventId: 0, Err: fmt.Errorf("refusing to redirect to empty URL")}
+		if useConfig {
+			return config, newBaseURL, nil
 		}
-		baseURL = preferences.URL
+		baseURL = newBaseURL
+	}
+	return nil, "", &fetcherError{EventId: 1104, Err: fmt.Errorf("redirection loop encountered while trying to fetch config JSON; please contact us at https://configcat.com/support/")}
+}
 
-		f.logger.Warnf(3002,
-			"the `config.DataGovernance` parameter specified at the client initialization is not in sync with the preferences on the ConfigCat Dashboard; "+
-				"read more: https://configcat.com/docs/advanced/data-governance/",
-		)
+// redirect returns the base URL that the preferences of config, which
+// was fetched from baseURL, redirect to (baseURL if they don't) and
+// reports whether config can be used. When it can't, config must be
+// fetched again from the returned base URL. The count argument holds
+// the number of the redirection.
+func (f *configFetcher) redirect(config *config, baseURL string, count int) (newBaseURL string, useConfig bool, err error) {
+	preferences := config.root.Preferences
+	if preferences == nil ||
+		preferences.Redirect == nil ||
+		preferences.URL == "" ||
+		preferences.URL == baseURL {
+		return baseURL, true, nil
+	}
+	redirect := *preferences.Redirect
+	if redirect == ForceRedirect {
+		f.logger.Debugf("forced redirect to %v (count %d)", preferences.URL, count)
+		return preferences.URL, false, nil
+	}
+	if f.urlIsCustom {
 		if redirect == NoDirect {
-			// We've already got the configuration data, we'll just fetch
-			// from the redirected URL next time.
-			f.logger.Debugf("redirection on next fetch to %v", baseURL)
-			return config, baseURL, nil
+			// The config is available, but we won't respect the redirection
+			// request for a custom URL.
+			f.logger.Debugf("config fetched but refusing to redirect from custom URL without forced redirection")
+			return baseURL, true, nil
 		}
-		if redirect != ShouldRedirect {
-			return nil, "", &fetcherError{EventId: 0, Err: fmt.Errorf("unknown redirection kind %d in response", redirect)}
-		}
-		f.logger.Debugf("redirecting to %v", baseURL)
+		// With shouldRedirect, there is no configuration available
+		// other than the redirection information itself, so error.
+		return "", false, &fetcherError{EventId: 0, Err: fmt.Errorf("refusing to redirect from custom URL without forced redirection")}
 	}
-	return nil, "", &fetcherError{EventId: 1104, Err: fmt.Errorf("redirection loop encountered while trying to fetch config JSON; please contact us at https://configcat.com/support/")}
+	f.logger.Warnf(3002,
+		"the `config.DataGovernance` parameter specified at the client initialization is not in sync with the preferences on the ConfigCat Dashboard; "+
+			"read more: https://configcat.com/docs/advanced/data-governance/",
+	)
+	if redirect == NoDirect {
+		// We've already got the configuration data, we'll just fetch
+		// from the redirected URL next time.
+		f.logger.Debugf("redirection on next fetch to %v", preferences.URL)
+		return preferences.URL, true, nil
+	}
+	if redirect != ShouldRedirect {
+		return "", false, &fetcherError{EventId: 0, Err: fmt.Errorf("unknown redirection kind %d in response", redirect)}
+	}
+	f.logger.Debugf("redirecting to %v", preferences.URL)
+	return preferences.URL, false, nil
 }
 
 // fetchHTTPWithoutRedirect does the actual HTTP fetch of the config.
@@ -388,7 +1087,6 @@ func (f *configFetcher) fetchHTTPWithoutRedirect(ctx context.Context, baseURL st
 	if prevConfig != nil && prevConfig.etag != "" {
 		request.Header.Add("If-None-Match", prevConfig.etag)
 	}
-	request = request.WithContext(f.ctx)
 	response, err := f.client.Do(request)
 	if err != nil {
 		if os.IsTimeout(err) {
@@ -417,9 +1115,45 @@ func (f *configFetcher) fetchHTTPWithoutRedirect(ctx context.Context, baseURL st
 		return config, nil
 	}
 	if response.StatusCode == http.StatusNotFound {
-		return nil, &fetcherError{EventId: 1100, Err: fmt.Errorf("your SDK Key seems to be wrong; you can find the valid SDK Key at https://app.configcat.com/sdkkey")}
+		return nil, &fetcherError{EventId: 1100, statusCode: response.StatusCode, Err: fmt.Errorf("your SDK Key seems to be wrong; you can find the valid SDK Key at https://app.configcat.com/sdkkey")}
+	}
+	fErr := &fetcherError{EventId: 1101, statusCode: response.StatusCode, Err: fmt.Errorf("unexpected HTTP response was received while trying to fetch config JSON: %v", response.Status)}
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		fErr.retryAfter = parseRetryAfter(response.Header.Get("Retry-After"), time.Now())
+	}
+	return nil, fErr
+}
+
+// endpoint holds the state of one of the configured base URLs.
+type endpoint struct {
+	// url holds the base URL as configured.
+	url string
+
+	// current holds the base URL to fetch from,
+	// which differs from url after a redirect.
+	current string
+
+	// consecutiveFailures holds the number of fetches from the
+	// endpoint that failed since the last successful one, and
+	// lastFailure the time of the most recent failure.
+	consecutiveFailures int
+	lastFailure         time.Time
+}
+
+// coolingDown reports whether ep failed too recently to be tried again
+// at time now. The cooldown starts at minEndpointCooldown and doubles
+// with each consecutive failure up to maxCooldown.
+func (ep *endpoint) coolingDown(now time.Time, maxCooldown time.Duration) bool {
+	if ep.consecutiveFailures == 0 {
+		return false
+	}
+	cooldown := maxCooldown
+	if shift := ep.consecutiveFailures - 1; shift < 16 {
+		if d := minEndpointCooldown << shift; d < cooldown {
+			cooldown = d
+		}
 	}
-	return nil, &fetcherError{EventId: 1101, Err: fmt.Errorf("unexpected HTTP response was received while trying to fetch config JSON: %v", response.Status)}
+	return now.Sub(ep.lastFailure) < cooldown
 }
 
 func pollingModeToIdentifier(pollingMode PollingMode) string {
@@ -430,6 +1164,8 @@ func pollingModeToIdentifier(pollingMode PollingMode) string {
 		return "l"
 	case Manual:
 		return "m"
+	case Streaming:
+		return "s"
 	default:
 		return "-"
 	}
@@ -461,10 +1197,18 @@ func (e *emptyFetcher) isOffline() bool {
 	return true
 }
 
+func (e *emptyFetcher) isStreaming() bool {
+	return false
+}
+
 func (e *emptyFetcher) setMode(_ bool) {
 	// no action
 }
 
+func (e *emptyFetcher) requestProbe() bool {
+	return false
+}
+
 func (e *emptyFetcher) context() context.Context {
 	return context.TODO()
 }
@@ -472,3 +1216,11 @@ func (e *emptyFetcher) context() context.Context {
 func (e *emptyFetcher) doneInitGet() chan struct{} {
 	return e.doneInitialGet
 }
+
+func (e *emptyFetcher) stats() ClientStats {
+	return ClientStats{}
+}
+
+func (e *emptyFetcher) shutdown(_ context.Context) error {
+	return nil
+}
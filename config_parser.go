@@ -18,6 +18,9 @@ type config struct {
 	keyValues  map[string]keyValue
 	fetchTime  time.Time
 	userInfos  *sync.Map
+	// fromCache holds whether the configuration
+	// was read from the cache.
+	fromCache bool
 	// values holds all the values that can be returned from the
 	// configuration, keyed by valueID-1.
 	values []interface{}
@@ -112,9 +115,12 @@ func (c *config) equalContent(c1 *config) bool {
 	return bytes.Equal(c.jsonBody, c1.jsonBody)
 }
 
+// withFetchTime returns a copy of c that has been confirmed
+// to be up to date at time t.
 func (c *config) withFetchTime(t time.Time) *config {
 	c1 := *c
 	c1.fetchTime = t
+	c1.fromCache = false
 	return &c1
 }
 
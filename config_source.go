@@ -0,0 +1,83 @@
+package configcat
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ConfigSource provides config JSON to the client in place of
+// the ConfigCat CDN. It can be used to load the configuration
+// from a file, a blob store or a message bus.
+//
+// The client takes care of everything else around the source:
+// concurrent refreshes, caching, hooks, readiness and flag overrides.
+type ConfigSource interface {
+	// Fetch returns the current config JSON along with its ETag and
+	// the time it was retrieved. eTag holds the ETag of the
+	// configuration that the client already has, if any.
+	//
+	// If the configuration hasn't changed since, Fetch may return
+	// a nil config along with the same ETag. Otherwise, a nil or
+	// empty config is an error. A zero fetch time stands for the
+	// current time.
+	Fetch(ctx context.Context, eTag string) (fetchTime time.Time, newETag string, config []byte, err error)
+}
+
+// NewFileConfigSource returns a ConfigSource that reads config JSON
+// from the file at the given path, for example a mounted Kubernetes ConfigMap.
+// The file is only read again when its size or modification time changes.
+func NewFileConfigSource(path string) ConfigSource {
+	return fileConfigSource{path: path}
+}
+
+type fileConfigSource struct {
+	path string
+}
+
+// Fetch implements ConfigSource.Fetch.
+func (s fileConfigSource) Fetch(_ context.Context, eTag string) (time.Time, string, []byte, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+	newETag := strconv.FormatInt(info.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(info.Size(), 36)
+	if newETag == eTag {
+		return time.Time{}, eTag, nil, nil
+	}
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return time.Time{}, "", nil, err
+	}
+	return time.Time{}, newETag, data, nil
+}
+
+// fetchFromSource fetches the configuration from f.source.
+func (f *configFetcher) fetchFromSource(ctx context.Context, prevConfig *config) (*config, error) {
+	var prevETag string
+	if prevConfig != nil {
+		prevETag = prevConfig.etag
+	}
+	fetchTime, eTag, body, err := f.source.Fetch(ctx, prevETag)
+	if err != nil {
+		return nil, &fetcherError{EventId: 1103, Err: fmt.Errorf("unexpected error occurred while trying to fetch config JSON from the config source: %v", err)}
+	}
+	if fetchTime.IsZero() {
+		fetchTime = time.Now()
+	}
+	if len(body) == 0 {
+		if prevConfig != nil && eTag == prevETag {
+			f.logger.Debugf("config fetch succeeded: not modified")
+			return prevConfig.withFetchTime(fetchTime), nil
+		}
+		return nil, &fetcherError{EventId: 1105, Err: fmt.Errorf("fetching config JSON from the config source was successful but there was no content")}
+	}
+	config, err := parseConfig(body, eTag, fetchTime, f.logger, f.defaultUser, f.overrides, f.hooks)
+	if err != nil {
+		return nil, &fetcherError{EventId: 1105, Err: fmt.Errorf("fetching config JSON from the config source was successful but the content was invalid: %v", err)}
+	}
+	f.logger.Debugf("config fetch succeeded: new config fetched")
+	return config, nil
+}
@@ -0,0 +1,146 @@
+package configcat
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+type testConfigSource struct {
+	mu     sync.Mutex
+	body   string
+	etag   string
+	err    error
+	etags  []string
+	copies int
+}
+
+func (s *testConfigSource) set(body, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.etag = body, etag
+}
+
+func (s *testConfigSource) Fetch(_ context.Context, eTag string) (time.Time, string, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.etags = append(s.etags, eTag)
+	if s.err != nil {
+		return time.Time{}, "", nil, s.err
+	}
+	if eTag == s.etag {
+		return time.Time{}, eTag, nil, nil
+	}
+	s.copies++
+	return time.Time{}, s.etag, []byte(s.body), nil
+}
+
+func TestConfigSource(t *testing.T) {
+	c := qt.New(t)
+	source := &testConfigSource{}
+	source.set(marshalJSON(rootNodeWithKeyValue("key", "value1")), "e1")
+	client := NewCustomClient(Config{
+		Source:      source,
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelError,
+	})
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	// Not modified.
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+	c.Assert(source.copies, qt.Equals, 1)
+	c.Assert(source.etags, qt.DeepEquals, []string{"", "e1"})
+
+	source.set(marshalJSON(rootNodeWithKeyValue("key", "value2")), "e2")
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2")
+}
+
+func TestConfigSource_ErrorFallsBackToCache(t *testing.T) {
+	c := qt.New(t)
+	source := &testConfigSource{err: errors.New("bus unavailable")}
+	cache := &customCache{items: map[string]string{}}
+	cfg := Config{
+		SDKKey:      "my-config",
+		Source:      source,
+		Cache:       cache,
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelNone,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.ErrorMatches, `config fetch failed: unexpected error occurred while trying to fetch config JSON from the config source: bus unavailable`)
+
+	source.err = nil
+	source.set(marshalJSON(rootNodeWithKeyValue("key", "value1")), "e1")
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(cache.allItems(), qt.HasLen, 1)
+
+	// A new client reads the cache when the source fails.
+	source.err = errors.New("bus unavailable")
+	client2 := NewCustomClient(cfg)
+	defer client2.Close()
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client2.GetStringValue("key", "", nil), qt.Equals, "value1")
+}
+
+func TestConfigSource_NoContent(t *testing.T) {
+	c := qt.New(t)
+	client := NewCustomClient(Config{
+		Source:      &testConfigSource{},
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelNone,
+	})
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.ErrorMatches, `config fetch failed: fetching config JSON from the config source was successful but there was no content`)
+	c.Assert(client.fetcher.current(), qt.IsNil)
+}
+
+func TestConfigSource_CacheWithoutSDKKey(t *testing.T) {
+	c := qt.New(t)
+	source := &testConfigSource{}
+	source.set(marshalJSON(rootNodeWithKeyValue("key", "value1")), "e1")
+	client := NewCustomClient(Config{
+		Source:      source,
+		Cache:       &customCache{items: map[string]string{}},
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelNone,
+	})
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "")
+}
+
+func TestFileConfigSource(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(marshalJSON(rootNodeWithKeyValue("key", "value1"))), 0o644)
+	c.Assert(err, qt.IsNil)
+	client := NewCustomClient(Config{
+		Source:      NewFileConfigSource(path),
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelError,
+	})
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	err = os.WriteFile(path, []byte(marshalJSON(rootNodeWithKeyValue("key", "value22"))), 0o644)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value22")
+}
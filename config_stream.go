@@ -0,0 +1,232 @@
+package configcat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/configcat/go-sdk/v9/configcatcache"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	streamMinReconnectDelay = time.Second
+	streamMaxReconnectDelay = 2 * time.Minute
+)
+
+// runStreamer keeps a Server-Sent Events connection open to the
+// current base URL and applies every configuration pushed over it.
+// When the connection can't be made or drops, it reconnects with
+// exponential backoff and polls at pollInterval until the stream
+// is back. When the server turns out not to support streaming at
+// all, it polls from then on. It runs until ctx is canceled, then
+// closes done.
+func (f *configFetcher) runStreamer(ctx context.Context, done chan struct{}, pollInterval time.Duration) {
+	defer f.wg.Done()
+	defer close(done)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	delay := streamMinReconnectDelay
+	for {
+		if f.isOffline() {
+			// Don't connect while offline: the polls read the
+			// cache or, when the fetcher went offline by itself,
+			// probe the CDN from time to time.
+			select {
+			case <-ticker.C:
+				_ = f.poll(pollInterval, true)
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		received, err := f.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			delay = streamMinReconnectDelay
+		}
+		if err.unsupported {
+			// Reconnecting would only get the same response.
+			f.logger.Warnf(err.EventId, "config stream unavailable; polling from now on: %v", err.Err)
+			_ = f.poll(pollInterval, false)
+			f.pollLoop(ctx, ticker, pollInterval)
+			return
+		}
+		if err.redirected {
+			f.logger.Debugf("config stream redirected; reconnecting to the new base URL")
+		} else {
+			f.logger.Warnf(err.EventId, "config stream disconnected; falling back to polling: %v", err.Err)
+		}
+
+		// Make sure we haven't missed anything while the stream was down.
+		_ = f.poll(pollInterval, false)
+
+		// Wait a random amount of time up to delay so that
+		// many clients don't all reconnect at the same moment.
+		timer := time.NewTimer(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+	wait:
+		for {
+			select {
+			case <-timer.C:
+				break wait
+			case <-ticker.C:
+				_ = f.poll(pollInterval, true)
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		if delay *= 2; delay > streamMaxReconnectDelay {
+			delay = streamMaxReconnectDelay
+		}
+	}
+}
+
+// streamError holds the reason why the stream was disconnected.
+type streamError struct {
+	fetcherError
+
+	// redirected is set when the stream was disconnected
+	// in order to reconnect to another base URL.
+	redirected bool
+
+	// unsupported is set when the server
+	// doesn't serve the config as an event stream.
+	unsupported bool
+}
+
+// stream connects to the event stream and applies configurations
+// until the connection fails or ctx is canceled. It reports whether
+// at least one event was received; the returned error is never nil.
+func (f *configFetcher) stream(ctx context.Context) (received bool, _ *streamError) {
+	if f.sdkKey == "" {
+		return false, &streamError{fetcherError: fetcherError{EventId: 0, Err: fmt.Errorf("empty SDK key in configcat configuration")}}
+	}
+	f.mu.Lock()
+	baseURL := f.baseURL
+	f.mu.Unlock()
+
+	request, err := http.NewRequestWithContext(ctx, "GET", baseURL+"/configuration-files/"+f.sdkKey+"/"+configcatcache.ConfigJSONName, nil)
+	if err != nil {
+		return false, &streamError{fetcherError: fetcherError{EventId: 0, Err: err}}
+	}
+	request.Header.Set("X-ConfigCat-UserAgent", "ConfigCat-Go/"+f.pollingIdentifier+"-"+version)
+	request.Header.Set("Accept", "text/event-stream")
+	request.Header.Set("Cache-Control", "no-cache")
+	response, err := f.streamClient.Do(request)
+	if err != nil {
+		return false, &streamError{fetcherError: fetcherError{EventId: 1103, Err: fmt.Errorf("unexpected error occurred while trying to open the config stream: %v", err)}}
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return false, &streamError{fetcherError: fetcherError{EventId: 1100, statusCode: response.StatusCode, Err: fmt.Errorf("your SDK Key seems to be wrong; you can find the valid SDK Key at https://app.configcat.com/sdkkey")}}
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, &streamError{fetcherError: fetcherError{EventId: 1101, statusCode: response.StatusCode, Err: fmt.Errorf("unexpected HTTP response was received while trying to open the config stream: %v", response.Status)}}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		return false, &streamError{
+			fetcherError: fetcherError{EventId: 1101, Err: fmt.Errorf("the server at %v doesn't support streaming (content type %q)", baseURL, mediaType)},
+			unsupported:  true,
+		}
+	}
+	f.logger.Debugf("config stream connected to %v", baseURL)
+	atomic.StoreUint32(&f.streaming, 1)
+	defer atomic.StoreUint32(&f.streaming, 0)
+
+	r := bufio.NewReader(response.Body)
+	var data strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = fmt.Errorf("stream closed by the server")
+			}
+			return received, &streamError{fetcherError: fetcherError{EventId: 1103, Err: fmt.Errorf("unexpected error occurred while reading the config stream: %v", err)}}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			// A blank line dispatches the event.
+			if data.Len() > 0 {
+				received = true
+				if err := f.applyStreamed(ctx, []byte(data.String()), baseURL); err != nil {
+					return received, err
+				}
+				data.Reset()
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// Comment, usually a keep-alive.
+			continue
+		}
+		// Note: the event ID identifies the event, not the
+		// config.json content, so it's not used as an ETag.
+		if field, value, _ := strings.Cut(line, ":"); field == "data" {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(value, " "))
+		}
+	}
+}
+
+// applyStreamed parses a config.json body received from the stream
+// opened to baseURL and makes it the current configuration.
+//
+// When the body redirects to another base URL, applyStreamed refreshes
+// the configuration, which follows the redirection like any other
+// fetch, and returns an error so that the stream is reopened to the
+// new base URL.
+func (f *configFetcher) applyStreamed(ctx context.Context, body []byte, baseURL string) *streamError {
+	config, err := parseConfig(body, "", time.Now(), f.logger, f.defaultUser, f.overrides, f.hooks)
+	if err != nil {
+		f.logger.Errorf(1105, "config received from the stream is invalid: %v", err)
+		return nil
+	}
+	f.logger.Debugf("config stream event received")
+	newBaseURL, useConfig, err := f.redirect(config, baseURL, 1)
+	if err != nil {
+		var fErr *fetcherError
+		errors.As(err, &fErr)
+		return &streamError{fetcherError: *fErr}
+	}
+	if useConfig {
+		f.fetchStats.recordPush()
+		prevConfig := f.current()
+		// Note: approve logs a rejection of the config.
+		rejectErr := f.approve(config, prevConfig)
+		f.mu.Lock()
+		switch {
+		case f.current() != prevConfig:
+			f.logger.Debugf("discarding the config received from the stream; another one has been applied in the meantime")
+		case rejectErr != nil:
+			f.keep(prevConfig)
+		case config.equalContent(prevConfig):
+			// Keep the ETag of the configuration we already had.
+			f.apply(prevConfig.withFetchTime(config.fetchTime), prevConfig)
+		default:
+			f.apply(config, prevConfig)
+		}
+		f.doneGetOnce.Do(func() {
+			close(f.doneInitialGet)
+		})
+		f.mu.Unlock()
+	}
+	if newBaseURL == baseURL {
+		return nil
+	}
+	_ = f.refreshIfOlder(ctx, time.Now(), true)
+	return &streamError{
+		fetcherError: fetcherError{EventId: 0, Err: fmt.Errorf("config stream redirected to %v", newBaseURL)},
+		redirected:   true,
+	}
+}
@@ -3,10 +3,12 @@ package configcat
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,6 +16,11 @@ const DefaultPollInterval = 60 * time.Second
 const proxyPrefix = "configcat-proxy/"
 const sdkKeyCompSize = 22
 
+// ErrClientClosed is returned by Client methods called after the
+// client has been closed, and reported in EvaluationDetailsData.Error
+// for evaluations made after that.
+var ErrClientClosed = errors.New("the client has been closed")
+
 // Hooks describes the events sent by Client.
 type Hooks struct {
 	// OnFlagEvaluated is called each time when the SDK evaluates a feature flag or setting.
@@ -24,6 +31,58 @@ type Hooks struct {
 
 	// OnConfigChanged is called, when a new config.json has downloaded.
 	OnConfigChanged func()
+
+	// OnConfigChangedWithDiff is like OnConfigChanged, but it's called
+	// with the differences between the settings of the previous
+	// configuration and the new one. When both are set, OnConfigChanged
+	// is called first.
+	OnConfigChangedWithDiff func(change *ConfigChange)
+
+	// OnBeforeConfigApply is called before a configuration that differs
+	// from the current one is put into use, with the current configuration
+	// (nil if there's none) and the new one, which must not be modified.
+	// If it returns an error, the new configuration is rejected and the
+	// current one stays in use; the rejection is logged and reported
+	// through OnError. It may be called concurrently with evaluations
+	// but never concurrently with itself. It can use the client, but
+	// Refresh calls made meanwhile don't wait for the configuration
+	// it's examining.
+	OnBeforeConfigApply func(old, new *ConfigJson) error
+
+	// OnStale is called with true when the client finds that its
+	// configuration has become older than Config.MaxConfigAge, and
+	// with false when it finds that it's been refreshed since. The
+	// age is checked whenever flags are evaluated.
+	OnStale func(stale bool)
+
+	// OnClientReady is called once, when the client becomes ready
+	// (see Client.Ready), with the state of the feature flag data
+	// the client evaluates with at that point.
+	OnClientReady func(state ClientCacheState)
+
+	// OnStateChange is called with true when the client switches to
+	// offline mode and with false when it switches back online,
+	// whether that's because SetOffline or SetOnline was called or
+	// automatically as described by Config.AutoOffline.
+	OnStateChange func(offline bool)
+
+	// dispatcher delivers the hook calls and watchers holds the
+	// watchers to update when the configuration changes. They're
+	// set on the copy of the hooks held by a client.
+	dispatcher *hookDispatcher
+	watchers   *flagWatchers
+}
+
+// dispatch calls f, which calls one of the hooks, through the hook dispatcher.
+func (hooks *Hooks) dispatch(f func()) {
+	hooks.dispatcher.dispatch(f)
+}
+
+// dispatchEvaluation is like dispatch for a call to OnFlagEvaluated,
+// which is dropped or delayed when the queue is full, as specified
+// by Config.HookOverflow.
+func (hooks *Hooks) dispatchEvaluation(f func()) {
+	hooks.dispatcher.dispatchEvaluation(f)
 }
 
 // Config describes configuration options for the Client.
@@ -45,11 +104,41 @@ type Config struct {
 	// If it's nil, no caching will be done.
 	Cache ConfigCache
 
+	// CacheTTL holds how long the entries the client writes to Cache
+	// remain valid when Cache implements ConfigCacheExt. If it's zero,
+	// they don't expire. It's ignored, with a warning, when Cache
+	// doesn't implement ConfigCacheExt.
+	CacheTTL time.Duration
+
+	// ChecksummedCacheFormat makes the client write cache entries in
+	// the checksummed v3 format (see configcatcache.CacheEntryToBytes)
+	// rather than in the v2 format. Only set it when all the clients
+	// sharing the cache use a version of this SDK that can read it, as
+	// ConfigCat SDKs for other languages can't. Entries in either format
+	// are read regardless.
+	ChecksummedCacheFormat bool
+
 	// BaseURL holds the URL of the ConfigCat CDN server.
 	// If this is empty, an appropriate URL will be chosen
 	// based on the DataGovernance parameter.
 	BaseURL string
 
+	// BaseURLs holds several base URLs in order of preference,
+	// for example a ConfigCat Proxy followed by the ConfigCat CDN.
+	// When fetching from one of them fails with a network or
+	// server error, the client switches to the next one, and
+	// it periodically tries the preferred one again.
+	// When this is non-empty, BaseURL is ignored.
+	BaseURLs []string
+
+	// Source provides the config JSON in place of the ConfigCat CDN.
+	// If it's nil, the configuration is fetched over HTTP from
+	// the base URL. When it's set, the SDKKey parameter is only
+	// used to identify the configuration in the cache, which is
+	// required when Cache is set, and the Streaming polling mode
+	// behaves like AutoPoll.
+	Source ConfigSource
+
 	// Transport is used as the HTTP transport for
 	// requests to the CDN. If it's nil, http.DefaultTransport
 	// will be used.
@@ -61,6 +150,16 @@ type Config struct {
 	// used.
 	HTTPTimeout time.Duration
 
+	// RetryPolicy controls how transient failures of config
+	// fetches are retried within a single refresh. If it's nil,
+	// the defaults described by RetryPolicy are used.
+	RetryPolicy *RetryPolicy
+
+	// AutoOffline, when non-nil, makes the client switch to offline
+	// mode by itself while the CDN can't be reached and back online
+	// once it can. See AutoOfflinePolicy for details.
+	AutoOffline *AutoOfflinePolicy
+
 	// PollingMode specifies how the configuration is refreshed.
 	// The zero value (default) is AutoPoll.
 	PollingMode PollingMode
@@ -69,7 +168,7 @@ type Config struct {
 	// GetIntValue, GetFloatValue, GetStringValue) should never wait for a
 	// configuration refresh to complete before returning.
 	//
-	// By default, when this is false, if PollingMode is AutoPoll,
+	// By default, when this is false, if PollingMode is AutoPoll or Streaming,
 	// the first request may block, and if PollingMode is Lazy, any
 	// request may block.
 	NoWaitForRefresh bool
@@ -78,9 +177,30 @@ type Config struct {
 	// be before it's considered stale. If this is less
 	// than 1, DefaultPollInterval is used.
 	//
+	// When PollingMode is Streaming, it's the interval used
+	// to poll while the stream is disconnected.
+	//
 	// This parameter is ignored when PollingMode is Manual.
 	PollInterval time.Duration
 
+	// MaxConfigAge holds the maximum age of a usable configuration.
+	// When the configuration was fetched longer ago than that, for
+	// example because the client has lost network access, evaluations
+	// return their default values with ErrConfigTooStale in
+	// EvaluationDetailsData.Error until the configuration is refreshed.
+	// If it's zero, the configuration is used however old it is.
+	// It's ignored when the flag overrides behavior is LocalOnly
+	// and while the config stream (see Streaming) is connected.
+	MaxConfigAge time.Duration
+
+	// StartFromCache specifies that, when PollingMode is AutoPoll or
+	// Streaming, NewCustomClient should read the configuration from
+	// Cache before returning and, if there's one, use it and consider
+	// the client ready straight away. The first refresh then happens
+	// in the background rather than delaying Ready and the first
+	// evaluations.
+	StartFromCache bool
+
 	// DataGovernance specifies the data governance mode.
 	// Set this parameter to be in sync with the Data Governance
 	// preference on the Dashboard at
@@ -104,8 +224,42 @@ type Config struct {
 	// Hooks controls the events sent by Client.
 	Hooks *Hooks
 
+	// HookQueueSize holds the maximum number of OnFlagEvaluated calls
+	// that can be waiting for delivery. Hooks are called in order from a
+	// single goroutine per client, so a slow hook delays the others.
+	// The calls to the other hooks are never dropped and don't count
+	// toward the limit. If it's less than 1, DefaultHookQueueSize is used.
+	HookQueueSize int
+
+	// HookOverflow specifies what happens to an OnFlagEvaluated call
+	// when the queue is full. The default is HookOverflowDrop.
+	HookOverflow HookOverflow
+
+	// HookSampleRate holds the sample rate used by HookOverflowSample.
+	// If it's less than 1, DefaultHookSampleRate is used.
+	HookSampleRate int
+
 	// Offline indicates whether the SDK should be initialized in offline mode or not.
 	Offline bool
+
+	// ShareFetcher specifies that the client should share the
+	// fetching of the configuration with the other clients in
+	// the process that set ShareFetcher and use the same
+	// parameters, other than DefaultUser, Logger, LogLevel, Hooks,
+	// the hook queue parameters, NoWaitForRefresh and MaxConfigAge.
+	// They then make a single set of requests and hold a single copy
+	// of the configuration, which is released when the last of them
+	// is closed.
+	//
+	// Each client keeps its own DefaultUser, Logger, LogLevel and
+	// Hooks: the messages logged while fetching are passed on to the
+	// logger of every client whose LogLevel enables them. Offline
+	// only sets the initial mode of the shared fetcher: SetOffline
+	// and SetOnline affect all the clients sharing it.
+	//
+	// A client whose Cache, Transport or Source has a type that
+	// can't be compared with == gets a fetcher of its own.
+	ShareFetcher bool
 }
 
 // ConfigCache is a cache API used to make custom cache implementations.
@@ -116,6 +270,38 @@ type ConfigCache interface {
 	Set(ctx context.Context, key string, value []byte) error
 }
 
+// ConfigCacheLocker can be implemented by a ConfigCache that is shared
+// between several processes, so that only one of them (the one holding
+// the lock) fetches the configuration and the others read it from
+// the cache. The lock is held as a lease, which its holder renews each
+// time it fetches successfully, so when the holder goes away or stops
+// fetching, another process takes over once the lease has expired.
+//
+// The client detects this interface by a type assertion on Config.Cache.
+type ConfigCacheLocker interface {
+	// TryLock tries to acquire the lock with the given key on behalf of
+	// owner for the duration of ttl, and reports whether owner holds it.
+	// When owner already holds the lock, TryLock extends the lease.
+	TryLock(ctx context.Context, key string, owner string, ttl time.Duration) (bool, error)
+	// Unlock releases the lock with the given key if it's held by owner.
+	Unlock(ctx context.Context, key string, owner string) error
+}
+
+// ConfigCacheExt can be implemented by a ConfigCache to let the client
+// expire entries and, when several processes share the cache, avoid
+// overwriting an entry with one holding an older fetch.
+//
+// The client detects this interface by a type assertion on Config.Cache.
+type ConfigCacheExt interface {
+	ConfigCache
+	// CompareAndSet is like Set except that it writes the entry only
+	// if the current entry is byte for byte equal to expected or, when
+	// expected is empty, if there's no entry, and that the entry expires
+	// after ttl. A zero ttl means that it doesn't expire. It reports
+	// whether it wrote the entry.
+	CompareAndSet(ctx context.Context, key string, value []byte, expected []byte, ttl time.Duration) (bool, error)
+}
+
 // DataGovernance describes the location of your feature flag and setting data within the ConfigCat CDN.
 type DataGovernance int
 
@@ -131,10 +317,47 @@ type Client struct {
 	logger         *leveledLogger
 	cfg            Config
 	fetcher        fetcher
-	needGetCheck   bool
 	firstFetchWait sync.Once
 	defaultUser    User
 	ready          chan struct{}
+
+	watchers flagWatchers
+
+	// polling holds the current polling parameters, which
+	// Reconfigure can change; reconfigureMu serializes
+	// calls to Reconfigure.
+	polling       atomic.Value // holds *pollingState
+	reconfigureMu sync.Mutex
+
+	// closed is 1 when the client has been closed.
+	// It's accessed atomically.
+	closed uint32
+
+	// stale is 1 when the configuration was last found to
+	// be older than cfg.MaxConfigAge. It's accessed atomically.
+	stale uint32
+}
+
+// pollingState holds the polling parameters of a client.
+type pollingState struct {
+	mode     PollingMode
+	interval time.Duration
+
+	// needGetCheck is set when getting a value may
+	// need to wait for or trigger a refresh.
+	needGetCheck bool
+}
+
+func newPollingState(mode PollingMode, interval time.Duration, noWaitForRefresh bool) *pollingState {
+	return &pollingState{
+		mode:         mode,
+		interval:     interval,
+		needGetCheck: mode == Lazy || (mode == AutoPoll || mode == Streaming) && !noWaitForRefresh,
+	}
+}
+
+func (client *Client) pollingState() *pollingState {
+	return client.polling.Load().(*pollingState)
 }
 
 // PollingMode specifies a strategy for refreshing the configuration.
@@ -155,6 +378,13 @@ const (
 	// is retrieved and the configuration is older than
 	// Config.PollInterval.
 	Lazy
+
+	// Streaming keeps a Server-Sent Events connection open
+	// to the base URL and applies each configuration pushed
+	// by the server as soon as it arrives. When the stream is
+	// unavailable, the client reconnects with exponential backoff
+	// and polls at Config.PollInterval in the meantime.
+	Streaming
 )
 
 // NewClient returns a new Client value that access the default
@@ -175,24 +405,36 @@ func NewCustomClient(cfg Config) *Client {
 	if cfg.PollInterval < 1 {
 		cfg.PollInterval = DefaultPollInterval
 	}
+	client := &Client{}
+	client.watchers.client = client
+	hooks := &Hooks{}
+	if cfg.Hooks != nil {
+		*hooks = *cfg.Hooks
+	}
+	hooks.dispatcher = newHookDispatcher(cfg)
+	hooks.watchers = &client.watchers
+	cfg.Hooks = hooks
 	logger := newLeveledLogger(cfg.Logger, cfg.LogLevel, cfg.Hooks)
 	if cfg.FlagOverrides != nil {
 		cfg.FlagOverrides.loadEntries(logger)
 	}
 	var f fetcher
-	if (cfg.FlagOverrides == nil || cfg.FlagOverrides.Behavior != LocalOnly) && !isValidSdkKey(cfg.SDKKey, cfg.BaseURL != "") {
+	if (cfg.FlagOverrides == nil || cfg.FlagOverrides.Behavior != LocalOnly) && cfg.Source == nil && !isValidSdkKey(cfg.SDKKey, cfg.BaseURL != "" || len(cfg.BaseURLs) > 0) {
 		logger.Errorf(0, "SDK Key '%s' is invalid", cfg.SDKKey)
 		f = newEmptyFetcher()
+	} else if cfg.Source != nil && cfg.Cache != nil && cfg.SDKKey == "" {
+		logger.Errorf(0, "an SDK Key is required to identify the configuration of the config source in the cache")
+		f = newEmptyFetcher()
+	} else if ref, ok := acquireSharedFetcher(cfg, logger); ok {
+		f = ref
 	} else {
 		f = newConfigFetcher(cfg, logger, cfg.DefaultUser)
 	}
-	client := &Client{
-		cfg:          cfg,
-		logger:       logger,
-		fetcher:      f,
-		needGetCheck: cfg.PollingMode == Lazy || cfg.PollingMode == AutoPoll && !cfg.NoWaitForRefresh,
-		defaultUser:  cfg.DefaultUser,
-	}
+	client.cfg = cfg
+	client.logger = logger
+	client.fetcher = f
+	client.polling.Store(newPollingState(cfg.PollingMode, cfg.PollInterval, cfg.NoWaitForRefresh))
+	client.defaultUser = cfg.DefaultUser
 
 	if cfg.PollingMode == Lazy || cfg.PollingMode == Manual {
 		client.ready = make(chan struct{})
@@ -200,25 +442,37 @@ func NewCustomClient(cfg Config) *Client {
 	} else {
 		client.ready = client.fetcher.doneInitGet()
 	}
+	if cfg.Hooks != nil && cfg.Hooks.OnClientReady != nil {
+		go client.notifyReady(cfg.Hooks.OnClientReady)
+	}
 
 	return client
 }
 
 // Refresh refreshes the cached configuration. If the context is
-// canceled while the refresh is in progress, Refresh will return but
-// the underlying HTTP request will not be canceled.
+// canceled while the refresh is in progress, Refresh will return
+// immediately. The underlying HTTP request is shared with concurrent
+// refreshes and is only canceled once all of them have given up.
 func (client *Client) Refresh(ctx context.Context) error {
 	// Note: add a tiny bit to the current time so that we refresh
 	// even if the current time hasn't changed since the last
 	// time we refreshed.
+	if client.isClosed() {
+		return ErrClientClosed
+	}
 	return client.fetcher.refreshIfOlder(ctx, time.Now().Add(1), true)
 }
 
 // RefreshIfOlder is like Refresh but refreshes the configuration only
 // if the most recently fetched configuration is older than the given
-// age.
+// age. It fails in offline mode, except when the client went offline
+// by itself (see Config.AutoOffline), in which case it probes the CDN
+// without waiting for AutoOfflinePolicy.ProbeInterval to elapse.
 func (client *Client) RefreshIfOlder(ctx context.Context, age time.Duration) error {
-	if client.fetcher.isOffline() {
+	if client.isClosed() {
+		return ErrClientClosed
+	}
+	if client.fetcher.isOffline() && !client.fetcher.requestProbe() {
 		var message = "client is in offline mode, it cannot initiate HTTP calls"
 		client.logger.Warnf(3200, message)
 		return fmt.Errorf(message)
@@ -243,14 +497,41 @@ func (client *Client) IsOffline() bool {
 
 // Ready indicates whether the SDK is initialized with feature flag data.
 // When the polling mode is Manual or Lazy, the SDK is considered ready right after instantiation.
-// When the polling mode is AutoPoll, Ready closes when the first initial HTTP request is finished.
+// When the polling mode is AutoPoll or Streaming, Ready closes when the first initial HTTP request is finished.
+// Use WaitForReady to find out what feature flag data the client has when it's ready.
 func (client *Client) Ready() <-chan struct{} {
 	return client.ready
 }
 
-// Close shuts down the client. After closing, it shouldn't be used.
+// Close shuts down the client, canceling any fetch in progress
+// and delivering any hook calls still queued. After closing,
+// evaluations return default values with ErrClientClosed in
+// EvaluationDetailsData.Error and refreshes fail with ErrClientClosed.
 func (client *Client) Close() {
+	atomic.StoreUint32(&client.closed, 1)
 	client.fetcher.close()
+	client.watchers.close()
+	client.cfg.Hooks.dispatcher.close()
+}
+
+// Shutdown is like Close except that it lets any fetch in progress
+// complete, including writing its result to the cache, before
+// returning. If ctx is done first, the fetch is canceled, the hook
+// calls still queued are delivered in the background and Shutdown
+// returns the context's error. It also returns any error that
+// occurs while shutting down.
+func (client *Client) Shutdown(ctx context.Context) error {
+	atomic.StoreUint32(&client.closed, 1)
+	err := client.fetcher.shutdown(ctx)
+	client.watchers.close()
+	if hookErr := client.cfg.Hooks.dispatcher.closeContext(ctx); err == nil {
+		err = hookErr
+	}
+	return err
+}
+
+func (client *Client) isClosed() bool {
+	return atomic.LoadUint32(&client.closed) == 1
 }
 
 // GetBoolValue returns the value of a boolean-typed feature flag, or defaultValue if no
@@ -332,13 +613,16 @@ func (client *Client) GetAllValues(user User) map[string]interface{} {
 // flags retrieved by the client, associated with the given user, or
 // Config.DefaultUser if user is nil.
 func (client *Client) Snapshot(user User) *Snapshot {
-	if client.needGetCheck {
-		switch client.cfg.PollingMode {
+	if client.isClosed() {
+		return newErrorSnapshot(nil, ErrClientClosed, user, client.logger, client.cfg.Hooks)
+	}
+	if polling := client.pollingState(); polling.needGetCheck {
+		switch polling.mode {
 		case Lazy:
-			if err := client.fetcher.refreshIfOlder(client.fetcher.context(), time.Now().Add(-client.cfg.PollInterval), !client.cfg.NoWaitForRefresh); err != nil {
+			if err := client.fetcher.refreshIfOlder(client.fetcher.context(), time.Now().Add(-polling.interval), !client.cfg.NoWaitForRefresh); err != nil {
 				client.logger.Errorf(0, "lazy refresh failed: %v", err)
 			}
-		case AutoPoll:
+		case AutoPoll, Streaming:
 			client.firstFetchWait.Do(func() {
 				// Note: we don't have to select on client.fetcher.ctx.Done here
 				// because if that's closed, the first fetch will be unblocked and
@@ -347,7 +631,42 @@ func (client *Client) Snapshot(user User) *Snapshot {
 			})
 		}
 	}
-	return newSnapshot(client.fetcher.current(), user, client.logger, client.cfg.Hooks)
+	cfg := client.fetcher.current()
+	if client.checkStale(cfg) {
+		return newErrorSnapshot(cfg, ErrConfigTooStale, user, client.logger, client.cfg.Hooks)
+	}
+	if ref, ok := client.fetcher.(*sharedFetcherRef); ok {
+		return ref.snapshot(cfg, user)
+	}
+	return newSnapshot(cfg, user, client.logger, client.cfg.Hooks)
+}
+
+// checkStale reports whether cfg is older than Config.MaxConfigAge,
+// logging and calling the OnStale hook when that changes. A config
+// kept up to date by a connected config stream is never stale, as
+// its fetch time only changes when an event is received.
+func (client *Client) checkStale(cfg *config) bool {
+	if client.cfg.MaxConfigAge <= 0 || cfg == nil || (client.cfg.FlagOverrides != nil && client.cfg.FlagOverrides.Behavior == LocalOnly) {
+		return false
+	}
+	stale := time.Since(cfg.fetchTime) > client.cfg.MaxConfigAge && !client.fetcher.isStreaming()
+	if stale {
+		if !atomic.CompareAndSwapUint32(&client.stale, 0, 1) {
+			return true
+		}
+		client.logger.Warnf(0, "the configuration fetched at %v is older than %v; returning default values until it's refreshed", cfg.fetchTime, client.cfg.MaxConfigAge)
+	} else {
+		if !atomic.CompareAndSwapUint32(&client.stale, 1, 0) {
+			return false
+		}
+		client.logger.Infof(0, "the configuration has been refreshed and is no longer too old")
+	}
+	if hooks := client.cfg.Hooks; hooks != nil && hooks.OnStale != nil {
+		hooks.dispatch(func() {
+			hooks.OnStale(stale)
+		})
+	}
+	return stale
 }
 
 func isValidSdkKey(sdkKey string, isCustomUrl bool) bool {
@@ -1,13 +1,16 @@
 package configcat
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"github.com/configcat/go-sdk/v9/configcatcache"
 	"io/ioutil"
 	"net/http"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -77,6 +80,151 @@ func TestClient_Refresh_Canceled(t *testing.T) {
 	c.Assert(result, qt.Equals, "value")
 }
 
+func TestClient_Refresh_CanceledAbortsRequest(t *testing.T) {
+	c := qt.New(t)
+	transport := newBlockingTransport()
+	cfg := Config{
+		SDKKey:      randomSdkKey(),
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelError,
+		Transport:   transport,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		errc <- client.Refresh(ctx)
+	}()
+	<-transport.started
+	cancel()
+	c.Assert(<-errc, qt.Equals, context.Canceled)
+	select {
+	case <-transport.canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("HTTP request was not canceled")
+	}
+}
+
+func TestClient_Refresh_CanceledWithOtherWaiter(t *testing.T) {
+	c := qt.New(t)
+	transport := newBlockingTransport()
+	cfg := Config{
+		SDKKey:      randomSdkKey(),
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelError,
+		Transport:   transport,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc1 := make(chan error)
+	go func() {
+		errc1 <- client.Refresh(ctx)
+	}()
+	<-transport.started
+	errc2 := make(chan error)
+	go func() {
+		errc2 <- client.Refresh(context.Background())
+	}()
+	// Wait for the second caller to join the in-flight fetch.
+	waitFor(t, func() bool {
+		f := client.fetcher.(*configFetcher)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.inflight != nil && f.inflight.waiters == 2
+	})
+	cancel()
+	c.Assert(<-errc1, qt.Equals, context.Canceled)
+	select {
+	case <-transport.canceled:
+		t.Fatalf("HTTP request was canceled while a caller was still waiting")
+	case <-time.After(20 * time.Millisecond):
+	}
+	transport.respond <- marshalJSON(rootNodeWithKeyValue("key", "value"))
+	c.Assert(<-errc2, qt.IsNil)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value")
+}
+
+func TestClient_Refresh_AfterCanceledFetch(t *testing.T) {
+	c := qt.New(t)
+	transport := newBlockingTransport()
+	cfg := Config{
+		SDKKey:      randomSdkKey(),
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelNone,
+		Transport:   transport,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	// Fill the channel so that the canceled
+	// request doesn't return until it's drained.
+	transport.canceled <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc1 := make(chan error)
+	go func() {
+		errc1 <- client.Refresh(ctx)
+	}()
+	<-transport.started
+	cancel()
+	c.Assert(<-errc1, qt.Equals, context.Canceled)
+
+	// A caller arriving while the canceled fetch
+	// is winding down gets a fetch of its own.
+	errc2 := make(chan error)
+	go func() {
+		errc2 <- client.Refresh(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	<-transport.canceled
+	<-transport.canceled
+	select {
+	case <-transport.started:
+	case err := <-errc2:
+		t.Fatalf("refresh completed without a new fetch: %v", err)
+	}
+	transport.respond <- marshalJSON(rootNodeWithKeyValue("key", "value"))
+	c.Assert(<-errc2, qt.IsNil)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value")
+}
+
+// blockingTransport is an http.RoundTripper that blocks
+// each request until a response body is sent on respond or
+// the request is canceled.
+type blockingTransport struct {
+	started  chan struct{}
+	canceled chan struct{}
+	respond  chan string
+}
+
+func newBlockingTransport() *blockingTransport {
+	return &blockingTransport{
+		started:  make(chan struct{}, 1),
+		canceled: make(chan struct{}, 1),
+		respond:  make(chan string),
+	}
+}
+
+func (b *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.started <- struct{}{}
+	select {
+	case body := <-b.respond:
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}, nil
+	case <-req.Context().Done():
+		b.canceled <- struct{}{}
+		return nil, req.Context().Err()
+	}
+}
+
 func TestClient_Refresh_Timeout(t *testing.T) {
 	c := qt.New(t)
 	srv := newConfigServer(t)
@@ -495,6 +643,109 @@ func TestClient_GetWithRedirectLoop(t *testing.T) {
 	c.Assert(srv2.allResponses(), qt.HasLen, 1)
 }
 
+func TestClient_BaseURLsFailover(t *testing.T) {
+	c := qt.New(t)
+	srv1 := newConfigServer(t)
+	srv2 := newConfigServerWithKey(t, srv1.key)
+	srv1.setResponse(configResponse{status: http.StatusServiceUnavailable, body: `unavailable`})
+	srv2.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv1.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.BaseURL = ""
+	cfg.BaseURLs = []string{srv1.srv.URL, srv2.srv.URL}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value")
+	c.Assert(srv1.allResponses(), qt.HasLen, 1)
+	c.Assert(srv2.allResponses(), qt.HasLen, 1)
+
+	// The next fetch goes straight to the healthy endpoint.
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv1.allResponses(), qt.HasLen, 1)
+	c.Assert(srv2.allResponses(), qt.HasLen, 2)
+
+	// Once the retry interval has passed, the preferred endpoint is tried again.
+	client.fetcher.(*configFetcher).preferredRetryInterval = 0
+	srv1.setResponseJSON(rootNodeWithKeyValue("key", "value1"))
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value1")
+	c.Assert(srv1.allResponses(), qt.HasLen, 2)
+	c.Assert(srv2.allResponses(), qt.HasLen, 2)
+}
+
+func TestClient_BaseURLsCooldown(t *testing.T) {
+	c := qt.New(t)
+	srv1 := newConfigServer(t)
+	srv2 := newConfigServerWithKey(t, srv1.key)
+	srv1.setResponse(configResponse{status: http.StatusServiceUnavailable, body: `unavailable`})
+	srv2.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv1.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.RetryPolicy = &RetryPolicy{MaxAttempts: 1}
+	cfg.BaseURLs = []string{srv1.srv.URL, srv2.srv.URL}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+
+	// The endpoint that has just failed isn't tried
+	// again when the one in use fails too.
+	srv2.setResponse(configResponse{status: http.StatusServiceUnavailable, body: `unavailable`})
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(srv1.allResponses(), qt.HasLen, 1)
+	c.Assert(srv2.allResponses(), qt.HasLen, 2)
+}
+
+func TestClient_BaseURLsNoFailoverOnInvalidSDKKey(t *testing.T) {
+	c := qt.New(t)
+	srv1 := newConfigServer(t)
+	srv2 := newConfigServerWithKey(t, srv1.key)
+	srv1.setResponse(configResponse{status: http.StatusNotFound, body: `not found`})
+	cfg := srv1.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.BaseURLs = []string{srv1.srv.URL, srv2.srv.URL}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	c.Assert(client.Refresh(context.Background()), qt.ErrorMatches, `config fetch failed: your SDK Key seems to be wrong.*`)
+	c.Assert(srv2.allResponses(), qt.HasLen, 0)
+}
+
+func TestClient_BaseURLsWithRedirect(t *testing.T) {
+	c := qt.New(t)
+	srv1 := newConfigServer(t)
+	srv2 := newConfigServerWithKey(t, srv1.key)
+	srv3 := newConfigServerWithKey(t, srv1.key)
+	srv1.setResponse(configResponse{status: http.StatusInternalServerError, body: `something failed`})
+	redirect := ForceRedirect
+	srv2.setResponseJSON(&ConfigJson{
+		Preferences: &Preferences{
+			URL:      srv3.srv.URL,
+			Redirect: &redirect,
+		},
+	})
+	srv3.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv1.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.BaseURLs = []string{srv1.srv.URL, srv2.srv.URL}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value")
+
+	// The redirect is remembered for the second endpoint.
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv1.allResponses(), qt.HasLen, 1)
+	c.Assert(srv2.allResponses(), qt.HasLen, 1)
+	c.Assert(srv3.allResponses(), qt.HasLen, 2)
+}
+
 func TestClient_GetWithInvalidConfig(t *testing.T) {
 	c := qt.New(t)
 	srv, client := getTestClients(t)
@@ -899,6 +1150,415 @@ func TestClient_Ready_Signal_Lazy(t *testing.T) {
 	c.Assert(val, qt.Equals, 5.561)
 }
 
+func TestClient_WaitForReady(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	readyState := make(chan ClientCacheState, 1)
+	cfg := srv.config()
+	cfg.Hooks = &Hooks{OnClientReady: func(state ClientCacheState) { readyState <- state }}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, HasUpToDateFlagData)
+	select {
+	case state := <-readyState:
+		c.Assert(state, qt.Equals, HasUpToDateFlagData)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for OnClientReady")
+	}
+}
+
+func TestClient_WaitForReady_CachedOnly(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{status: http.StatusInternalServerError})
+	cfg := srv.config()
+	cfg.LogLevel = LogLevelNone
+	cfg.PollInterval = time.Minute
+	cfg.Cache = &simpleCache{
+		entry: configcatcache.CacheSegmentsToBytes(time.Now().Add(-2*time.Minute), "etag", []byte(marshalJSON(rootNodeWithKeyValue("key", "value")))),
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, HasCachedFlagDataOnly)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value")
+}
+
+func TestClient_CacheState_StaleFetchedConfig(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.PollingMode = Lazy
+	cfg.PollInterval = 20 * time.Millisecond
+	cfg.HTTPTimeout = 20 * time.Millisecond
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, HasUpToDateFlagData)
+
+	// The configuration was fetched rather than read from the
+	// cache, but it's too old to be up to date all the same.
+	time.Sleep(3 * cfg.PollInterval)
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, HasCachedFlagDataOnly)
+}
+
+func TestClient_CacheState_FetchSlack(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.PollingMode = Lazy
+	cfg.PollInterval = 50 * time.Millisecond
+	cfg.HTTPTimeout = time.Hour
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+
+	// The next fetch may take up to the HTTP timeout.
+	time.Sleep(2 * cfg.PollInterval)
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, HasUpToDateFlagData)
+}
+
+func TestClient_WaitForReady_NoFlagData(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{status: http.StatusInternalServerError})
+	cfg := srv.config()
+	cfg.LogLevel = LogLevelNone
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, NoFlagData)
+}
+
+func TestClient_WaitForReady_LocalOverridesOnly(t *testing.T) {
+	c := qt.New(t)
+	cfg := Config{
+		SDKKey: "local",
+		FlagOverrides: &FlagOverrides{
+			Behavior: LocalOnly,
+			Values:   map[string]interface{}{"key": "value"},
+		},
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, HasLocalOverrideFlagDataOnly)
+}
+
+func TestClient_WaitForReady_ContextDone(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{
+		body:  marshalJSON(rootNodeWithKeyValue("key", "value")),
+		sleep: 200 * time.Millisecond,
+	})
+	client := NewCustomClient(srv.config())
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	c.Assert(client.WaitForReady(ctx), qt.Equals, NoFlagData)
+}
+
+func TestClient_Stats(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.RetryPolicy = &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	stats := client.Stats()
+	c.Assert(stats.ConfigOrigin, qt.Equals, ConfigOriginNone)
+	c.Assert(stats.Fetches, qt.Equals, uint64(0))
+	c.Assert(stats.BaseURL, qt.Equals, srv.srv.URL)
+
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	stats = client.Stats()
+	c.Assert(stats.ConfigOrigin, qt.Equals, ConfigOriginHTTP)
+	c.Assert(stats.Fetches, qt.Equals, uint64(2))
+	c.Assert(stats.ModifiedResponses, qt.Equals, uint64(1))
+	c.Assert(stats.NotModifiedResponses, qt.Equals, uint64(1))
+	c.Assert(stats.LastSuccessfulFetch.IsZero(), qt.IsFalse)
+	c.Assert(stats.ConfigFetchTime, qt.Equals, client.fetcher.current().fetchTime)
+	c.Assert(stats.AverageFetchLatency > 0, qt.IsTrue)
+	c.Assert(stats.LastError, qt.IsNil)
+
+	srv.setResponse(configResponse{status: http.StatusInternalServerError})
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(client.Refresh(context.Background()), qt.Not(qt.IsNil))
+	stats = client.Stats()
+	// Each failed refresh was retried, but counts as a single fetch.
+	c.Assert(srv.allResponses(), qt.HasLen, 6)
+	c.Assert(stats.Fetches, qt.Equals, uint64(4))
+	c.Assert(stats.ConsecutiveFailures, qt.Equals, 2)
+	c.Assert(stats.LastError, qt.ErrorMatches, `unexpected HTTP response was received while trying to fetch config JSON: 500 Internal Server Error`)
+	c.Assert(stats.LastErrorEventId, qt.Equals, 1101)
+
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.Stats().ConsecutiveFailures, qt.Equals, 0)
+}
+
+func TestClient_Stats_Redirect(t *testing.T) {
+	c := qt.New(t)
+	srv1, client := getTestClients(t)
+	srv2, _ := getTestClients(t)
+	srv2.key = srv1.key
+	redirect := ForceRedirect
+	srv1.setResponseJSON(&ConfigJson{
+		Preferences: &Preferences{
+			URL:      srv2.config().BaseURL,
+			Redirect: &redirect,
+		},
+	})
+	srv2.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv1.allResponses(), qt.HasLen, 1)
+	c.Assert(srv2.allResponses(), qt.HasLen, 1)
+	stats := client.Stats()
+	c.Assert(stats.Fetches, qt.Equals, uint64(1))
+	c.Assert(stats.ModifiedResponses, qt.Equals, uint64(1))
+}
+
+func TestClient_Stats_Origin(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{status: http.StatusInternalServerError})
+	cfg := srv.config()
+	cfg.LogLevel = LogLevelNone
+	cfg.Cache = &simpleCache{
+		entry: configcatcache.CacheSegmentsToBytes(time.Now(), "etag", []byte(marshalJSON(rootNodeWithKeyValue("key", "value")))),
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	<-client.Ready()
+	c.Assert(client.Stats().ConfigOrigin, qt.Equals, ConfigOriginCache)
+
+	client = NewCustomClient(Config{
+		SDKKey:        "local",
+		FlagOverrides: &FlagOverrides{Behavior: LocalOnly, Values: map[string]interface{}{"key": "value"}},
+	})
+	defer client.Close()
+	c.Assert(client.Stats().ConfigOrigin, qt.Equals, ConfigOriginOverrides)
+}
+
+func TestClient_MaxConfigAge(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	staleCh := make(chan bool, 2)
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.MaxConfigAge = 50 * time.Millisecond
+	cfg.Hooks = &Hooks{OnStale: func(stale bool) { staleCh <- stale }}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value")
+
+	time.Sleep(2 * cfg.MaxConfigAge)
+	details := client.GetStringValueDetails("key", "default", nil)
+	c.Assert(details.Value, qt.Equals, "default")
+	c.Assert(details.Data.IsDefaultValue, qt.IsTrue)
+	c.Assert(errors.Is(details.Data.Error, ErrConfigTooStale), qt.IsTrue)
+	c.Assert(details.Data.FetchTime, qt.Equals, client.fetcher.current().fetchTime)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "default")
+	c.Assert(<-staleCh, qt.IsTrue)
+
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value")
+	c.Assert(<-staleCh, qt.IsFalse)
+	select {
+	case stale := <-staleCh:
+		t.Fatalf("unexpected OnStale(%v) call", stale)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestClient_OnBeforeConfigApply(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(&ConfigJson{
+		Settings: map[string]*Setting{
+			"a": {Value: &SettingValue{Value: "a1"}},
+			"b": {Value: &SettingValue{Value: "b1"}},
+		},
+	})
+	errCh := make(chan error, 1)
+	cache := &simpleCache{}
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.Cache = cache
+	cfg.Hooks = &Hooks{
+		OnBeforeConfigApply: func(old, new *ConfigJson) error {
+			if old != nil && len(new.Settings) < len(old.Settings) {
+				return fmt.Errorf("%d settings removed", len(old.Settings)-len(new.Settings))
+			}
+			return nil
+		},
+		OnError: func(err error) {
+			errCh <- err
+		},
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("b", "", nil), qt.Equals, "b1")
+	cached := string(cache.entry)
+
+	// A config that removes a setting is rejected, although
+	// the current one counts as refreshed.
+	srv.setResponseJSON(&ConfigJson{
+		Settings: map[string]*Setting{
+			"a": {Value: &SettingValue{Value: "a2"}},
+		},
+	})
+	fetchTime := client.fetcher.current().fetchTime
+	c.Assert(client.Refresh(context.Background()), qt.ErrorMatches, `config fetch failed: new config rejected: 1 settings removed`)
+	c.Assert(client.fetcher.current().fetchTime.After(fetchTime), qt.IsTrue)
+	c.Assert(client.GetStringValue("a", "", nil), qt.Equals, "a1")
+	c.Assert(client.GetStringValue("b", "", nil), qt.Equals, "b1")
+	c.Assert(string(cache.entry), qt.Equals, cached)
+	select {
+	case err := <-errCh:
+		c.Assert(err, qt.ErrorMatches, `.*1 settings removed`)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for OnError")
+	}
+
+	// Other changes are accepted.
+	srv.setResponseJSON(&ConfigJson{
+		Settings: map[string]*Setting{
+			"a": {Value: &SettingValue{Value: "a2"}},
+			"b": {Value: &SettingValue{Value: "b2"}},
+		},
+	})
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("a", "", nil), qt.Equals, "a2")
+}
+
+func TestClient_OnBeforeConfigApply_UsesClient(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	var client *Client
+	values := make(chan string, 1)
+	cfg := srv.config()
+	cfg.PollingMode = Lazy
+	cfg.Hooks = &Hooks{
+		OnBeforeConfigApply: func(old, new *ConfigJson) error {
+			// The hook can use the client while it decides.
+			_ = client.Stats()
+			_ = client.Refresh(context.Background())
+			values <- client.GetStringValue("key", "default", nil)
+			return nil
+		},
+	}
+	client = NewCustomClient(cfg)
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Refresh(context.Background())
+	}()
+	select {
+	case err := <-done:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("deadlock calling the client from OnBeforeConfigApply")
+	}
+	c.Assert(<-values, qt.Equals, "default")
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value")
+}
+
+func TestClient_Shutdown(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{
+		body:  marshalJSON(rootNodeWithKeyValue("key", "value")),
+		sleep: 50 * time.Millisecond,
+	})
+	var changed int32
+	cache := &simpleCache{}
+	cfg := srv.config()
+	cfg.Cache = cache
+	cfg.Hooks = &Hooks{OnConfigChanged: func() {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&changed, 1)
+	}}
+	client := NewCustomClient(cfg)
+
+	// The initial fetch is in progress: Shutdown waits for it,
+	// its cache write and the resulting hook call.
+	c.Assert(client.Shutdown(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+	cached, _ := cache.Get(context.Background(), "")
+	c.Assert(cached, qt.Not(qt.HasLen), 0)
+	c.Assert(atomic.LoadInt32(&changed), qt.Equals, int32(1))
+
+	details := client.GetStringValueDetails("key", "default", nil)
+	c.Assert(details.Value, qt.Equals, "default")
+	c.Assert(details.Data.IsDefaultValue, qt.IsTrue)
+	c.Assert(errors.Is(details.Data.Error, ErrClientClosed), qt.IsTrue)
+	c.Assert(client.Refresh(context.Background()), qt.Equals, ErrClientClosed)
+	c.Assert(client.RefreshIfOlder(context.Background(), 0), qt.Equals, ErrClientClosed)
+	c.Assert(client.Shutdown(context.Background()), qt.IsNil)
+	client.Close()
+}
+
+func TestClient_FlagEvaluatedWithoutConfig(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	evaluated := make(chan *EvaluationDetails, 1)
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.MaxConfigAge = 20 * time.Millisecond
+	cfg.Hooks = &Hooks{OnFlagEvaluated: func(details *EvaluationDetails) { evaluated <- details }}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+
+	// Evaluations that fail because the configuration is too
+	// old or the client is closed are reported all the same.
+	time.Sleep(2 * cfg.MaxConfigAge)
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "default")
+	details := <-evaluated
+	c.Assert(details.Data.Key, qt.Equals, "key")
+	c.Assert(details.Data.IsDefaultValue, qt.IsTrue)
+	c.Assert(details.Data.Error, qt.Equals, ErrConfigTooStale)
+
+	client.Close()
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "default")
+	details = <-evaluated
+	c.Assert(details.Data.Error, qt.Equals, ErrClientClosed)
+}
+
+func TestClient_Shutdown_Timeout(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{
+		body:  marshalJSON(rootNodeWithKeyValue("key", "value")),
+		sleep: 500 * time.Millisecond,
+	})
+	cfg := srv.config()
+	cfg.LogLevel = LogLevelNone
+	client := NewCustomClient(cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := client.Shutdown(ctx)
+	c.Assert(err, qt.ErrorMatches, `gave up waiting for the config fetch to complete: context deadline exceeded`)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+	c.Assert(time.Since(start) < 400*time.Millisecond, qt.IsTrue)
+}
+
 func TestClient_InitOffline(t *testing.T) {
 	c := qt.New(t)
 	srv := newConfigServer(t)
@@ -1085,3 +1745,30 @@ func (m *mockHTTPTransport) enqueue(statusCode int, body string) {
 		Body:       ioutil.NopCloser(strings.NewReader(body)),
 	})
 }
+
+func TestClient_CacheEntryFormat(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cache := &simpleCache{}
+	cfg.Cache = cache
+	client := NewCustomClient(cfg)
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	client.Close()
+	// The v2 format is written by default.
+	_, etag, body, err := configcatcache.CacheSegmentsFromBytes(cache.entry)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(cache.entry), qt.Equals, string(configcatcache.CacheSegmentsToBytes(client.fetcher.current().fetchTime, etag, body)))
+
+	cfg.ChecksummedCacheFormat = true
+	cache.entry = nil
+	client = NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(bytes.HasPrefix(cache.entry, []byte("\x89CCE\x03")), qt.IsTrue)
+	_, _, body, err = configcatcache.CacheSegmentsFromBytes(cache.entry)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(body), qt.Equals, marshalJSON(rootNodeWithKeyValue("key", "value")))
+}
@@ -3,6 +3,7 @@ package configcatcache
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
@@ -13,7 +14,15 @@ import (
 const newLineByte byte = '\n'
 
 // CacheSegmentsFromBytes deserializes a cache entry from a specific format used by the SDK.
+// It reads entries written by either CacheSegmentsToBytes (the v2 format)
+// or CacheEntryToBytes (the v3 format).
 func CacheSegmentsFromBytes(cacheBytes []byte) (fetchTime time.Time, eTag string, config []byte, err error) {
+	if bytes.HasPrefix(cacheBytes, []byte(envelopeMagic)) {
+		cacheBytes, err = openEnvelope(cacheBytes)
+		if err != nil {
+			return time.Time{}, "", nil, err
+		}
+	}
 	fetchTimeIndex := bytes.IndexByte(cacheBytes, newLineByte)
 	eTagIndex := bytes.IndexByte(cacheBytes[fetchTimeIndex+1:], newLineByte)
 	if fetchTimeIndex == -1 || eTagIndex == -1 {
@@ -59,3 +68,12 @@ func ProduceCacheKey(sdkKey string, configJSONName string, cacheVersion string)
 	h.Write([]byte(sdkKey + "_" + configJSONName + "_" + cacheVersion))
 	return hex.EncodeToString(h.Sum(nil))
 }
+
+// ConfigCache is the cache API used by the SDK. It's identical to
+// configcat.ConfigCache, which can't be referred to from this package.
+type ConfigCache interface {
+	// Get reads the configuration from the cache.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set writes the configuration into the cache.
+	Set(ctx context.Context, key string, value []byte) error
+}
@@ -0,0 +1,85 @@
+package configcatcache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Chain returns a ConfigCache that layers the given caches, which
+// should be ordered from the fastest (typically a MemoryCache) to
+// the slowest (for example a cache backed by Redis).
+//
+// Get reads from each layer in turn until one of them holds an
+// entry, then writes that entry back to the faster layers that
+// didn't have it. Set writes to every layer.
+//
+// The layers are isolated from each other's failures: Get skips a
+// layer that fails and only returns an error when no layer had an
+// entry, and Set writes to the other layers before returning the
+// errors of the layers that failed. Errors that occur when writing
+// back an entry found by Get are ignored.
+//
+// The returned cache doesn't implement the SDK's ConfigCacheLocker
+// interface, even when some of the layers do.
+func Chain(caches ...ConfigCache) ConfigCache {
+	return &chain{
+		caches: caches,
+	}
+}
+
+type chain struct {
+	caches []ConfigCache
+}
+
+func (c *chain) Get(ctx context.Context, key string) ([]byte, error) {
+	var errs layerErrors
+	for i, cache := range c.caches {
+		value, err := cache.Get(ctx, key)
+		if err != nil {
+			errs = append(errs, layerError{i, err})
+			continue
+		}
+		if len(value) == 0 {
+			continue
+		}
+		for _, faster := range c.caches[:i] {
+			_ = faster.Set(ctx, key, value)
+		}
+		return value, nil
+	}
+	return nil, errs.err()
+}
+
+func (c *chain) Set(ctx context.Context, key string, value []byte) error {
+	var errs layerErrors
+	for i, cache := range c.caches {
+		if err := cache.Set(ctx, key, value); err != nil {
+			errs = append(errs, layerError{i, err})
+		}
+	}
+	return errs.err()
+}
+
+type layerError struct {
+	layer int
+	err   error
+}
+
+type layerErrors []layerError
+
+// err returns an error describing the failures of all the layers,
+// wrapping the error of the first one, or nil if there are none.
+func (errs layerErrors) err() error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("cache layer %d: %w", errs[0].layer, errs[0].err)
+	}
+	msgs := make([]string, 0, len(errs)-1)
+	for _, e := range errs[1:] {
+		msgs = append(msgs, fmt.Sprintf("cache layer %d: %v", e.layer, e.err))
+	}
+	return fmt.Errorf("cache layer %d: %w; %s", errs[0].layer, errs[0].err, strings.Join(msgs, "; "))
+}
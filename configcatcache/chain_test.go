@@ -0,0 +1,65 @@
+package configcatcache
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestChainCache(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	fast, slow := NewMemoryCache(), NewMemoryCache()
+	cache := Chain(fast, slow)
+
+	value, err := cache.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.IsNil)
+
+	// A hit in a slower layer is written back to the faster ones.
+	c.Assert(slow.Set(ctx, "key", []byte("value")), qt.IsNil)
+	value, err = cache.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(value), qt.Equals, "value")
+	value, _ = fast.Get(ctx, "key")
+	c.Assert(string(value), qt.Equals, "value")
+
+	// Writes go through all layers.
+	c.Assert(cache.Set(ctx, "key", []byte("value2")), qt.IsNil)
+	value, _ = fast.Get(ctx, "key")
+	c.Assert(string(value), qt.Equals, "value2")
+	value, _ = slow.Get(ctx, "key")
+	c.Assert(string(value), qt.Equals, "value2")
+}
+
+func TestChainCache_FailingLayer(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	fast := NewMemoryCache()
+	cache := Chain(fast, failingCache{})
+
+	err := cache.Set(ctx, "key", []byte("value"))
+	c.Assert(err, qt.ErrorMatches, `cache layer 1: fake failing cache fails to set`)
+	value, err := cache.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(value), qt.Equals, "value")
+
+	_, err = cache.Get(ctx, "other")
+	c.Assert(err, qt.ErrorMatches, `cache layer 1: fake failing cache fails to get`)
+
+	_, err = Chain(failingCache{}, failingCache{}).Get(ctx, "key")
+	c.Assert(err, qt.ErrorMatches, `cache layer 0: fake failing cache fails to get; cache layer 1: fake failing cache fails to get`)
+}
+
+// failingCache is a cache whose every operation fails.
+type failingCache struct{}
+
+func (failingCache) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errors.New("fake failing cache fails to get")
+}
+
+func (failingCache) Set(ctx context.Context, key string, value []byte) error {
+	return errors.New("fake failing cache fails to set")
+}
@@ -0,0 +1,141 @@
+package configcatcache
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// encryptedMagic starts every entry written by an Encrypted cache.
+const encryptedMagic = "configcat-enc1"
+
+// Keyring holds the keys used by an Encrypted cache.
+type Keyring struct {
+	// CurrentID holds the ID of the key that entries are sealed with.
+	CurrentID string
+
+	// Keys holds the AES keys (16, 24 or 32 bytes long) by ID.
+	// After rotating to a new key, keep the previous one here
+	// until the entries sealed with it have been rewritten.
+	Keys map[string][]byte
+}
+
+// Encrypted returns a ConfigCache that seals the entries it writes to
+// inner with AES-GCM, using the current key of keyring, and opens the
+// entries it reads with the key they were sealed with. Each entry is
+// bound to its cache key, so an entry copied under another key can't
+// be opened.
+//
+// An entry that can't be opened, because it's been sealed with a key
+// that's not in the keyring, it's been tampered with or it wasn't
+// written by an Encrypted cache, is treated as a cache miss. As the
+// SDK then writes the configuration it fetches, entries are resealed
+// with the current key after a key rotation.
+//
+// Set fails if the current key is missing or invalid.
+func Encrypted(inner ConfigCache, keyring Keyring) ConfigCache {
+	c := &encrypted{
+		inner:     inner,
+		currentID: keyring.CurrentID,
+		aeads:     make(map[string]cipher.AEAD),
+	}
+	for id, key := range keyring.Keys {
+		aead, err := newGCM(id, key)
+		if err != nil {
+			if id == keyring.CurrentID {
+				c.sealErr = err
+			}
+			continue
+		}
+		c.aeads[id] = aead
+	}
+	if c.aeads[c.currentID] == nil && c.sealErr == nil {
+		c.sealErr = fmt.Errorf("no key with the current ID %q in the keyring", c.currentID)
+	}
+	return c
+}
+
+func newGCM(id string, key []byte) (cipher.AEAD, error) {
+	if id == "" || strings.ContainsRune(id, '\n') {
+		return nil, fmt.Errorf("invalid key ID %q", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key %q: %v", id, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+type encrypted struct {
+	inner     ConfigCache
+	currentID string
+	aeads     map[string]cipher.AEAD
+
+	// sealErr holds the reason why entries can't be sealed, if any.
+	sealErr error
+}
+
+// Get implements ConfigCache.Get.
+func (c *encrypted) Get(ctx context.Context, key string) ([]byte, error) {
+	sealed, err := c.inner.Get(ctx, key)
+	if err != nil || len(sealed) == 0 {
+		return nil, err
+	}
+	value, ok := c.open(key, sealed)
+	if !ok {
+		return nil, nil
+	}
+	return value, nil
+}
+
+// Set implements ConfigCache.Set.
+func (c *encrypted) Set(ctx context.Context, key string, value []byte) error {
+	if c.sealErr != nil {
+		return fmt.Errorf("cannot encrypt cache entry: %v", c.sealErr)
+	}
+	aead := c.aeads[c.currentID]
+	// The entry holds the magic string, the key ID,
+	// the nonce and the sealed value, in that order.
+	header := encryptedMagic + "\n" + c.currentID + "\n"
+	sealed := make([]byte, len(header)+aead.NonceSize(), len(header)+aead.NonceSize()+len(value)+aead.Overhead())
+	copy(sealed, header)
+	nonce := sealed[len(header):]
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("cannot encrypt cache entry: %v", err)
+	}
+	sealed = aead.Seal(sealed, nonce, value, additionalData(key, c.currentID))
+	return c.inner.Set(ctx, key, sealed)
+}
+
+// open returns the value sealed in the given entry
+// and reports whether it could be opened.
+func (c *encrypted) open(key string, sealed []byte) ([]byte, bool) {
+	prefix := []byte(encryptedMagic + "\n")
+	if !bytes.HasPrefix(sealed, prefix) {
+		return nil, false
+	}
+	id, rest, ok := bytes.Cut(sealed[len(prefix):], []byte("\n"))
+	if !ok {
+		return nil, false
+	}
+	aead := c.aeads[string(id)]
+	if aead == nil || len(rest) < aead.NonceSize() {
+		return nil, false
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	value, err := aead.Open(nil, nonce, ciphertext, additionalData(key, string(id)))
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// additionalData returns the data that's authenticated along with
+// an entry, which binds the entry to its cache key and key ID.
+func additionalData(key, id string) []byte {
+	return []byte(encryptedMagic + "\n" + id + "\n" + key)
+}
@@ -0,0 +1,90 @@
+package configcatcache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var (
+	testKey1 = bytes.Repeat([]byte{1}, 32)
+	testKey2 = bytes.Repeat([]byte{2}, 16)
+)
+
+func TestEncryptedCache(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	inner := NewMemoryCache()
+	cache := Encrypted(inner, Keyring{
+		CurrentID: "k1",
+		Keys:      map[string][]byte{"k1": testKey1},
+	})
+	c.Assert(cache.Set(ctx, "key", []byte("secret value")), qt.IsNil)
+	sealed, _ := inner.Get(ctx, "key")
+	c.Assert(bytes.Contains(sealed, []byte("secret")), qt.IsFalse)
+	value, err := cache.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(value), qt.Equals, "secret value")
+
+	// After a key rotation, entries sealed with the previous key can
+	// still be read and new entries are sealed with the new key.
+	rotated := Encrypted(inner, Keyring{
+		CurrentID: "k2",
+		Keys:      map[string][]byte{"k1": testKey1, "k2": testKey2},
+	})
+	value, err = rotated.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(value), qt.Equals, "secret value")
+	c.Assert(rotated.Set(ctx, "key", []byte("new value")), qt.IsNil)
+	value, err = cache.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.IsNil)
+}
+
+func TestEncryptedCache_Miss(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	inner := NewMemoryCache()
+	cache := Encrypted(inner, Keyring{
+		CurrentID: "k1",
+		Keys:      map[string][]byte{"k1": testKey1},
+	})
+	c.Assert(cache.Set(ctx, "key", []byte("value")), qt.IsNil)
+
+	// An entry moved to another key can't be opened.
+	sealed, _ := inner.Get(ctx, "key")
+	c.Assert(inner.Set(ctx, "other", sealed), qt.IsNil)
+	value, err := cache.Get(ctx, "other")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.IsNil)
+
+	// Nor can a tampered with or plaintext entry.
+	sealed[len(sealed)-1] ^= 1
+	c.Assert(inner.Set(ctx, "key", sealed), qt.IsNil)
+	value, err = cache.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.IsNil)
+	c.Assert(inner.Set(ctx, "key", []byte("value")), qt.IsNil)
+	value, err = cache.Get(ctx, "key")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.IsNil)
+}
+
+func TestEncryptedCache_InvalidKey(t *testing.T) {
+	c := qt.New(t)
+	cache := Encrypted(NewMemoryCache(), Keyring{
+		CurrentID: "k1",
+		Keys:      map[string][]byte{"k1": []byte("short")},
+	})
+	err := cache.Set(context.Background(), "key", []byte("value"))
+	c.Assert(err, qt.ErrorMatches, `cannot encrypt cache entry: invalid key "k1": crypto/aes: invalid key size 5`)
+
+	cache = Encrypted(NewMemoryCache(), Keyring{
+		CurrentID: "k2",
+		Keys:      map[string][]byte{"k1": testKey1},
+	})
+	err = cache.Set(context.Background(), "key", []byte("value"))
+	c.Assert(err, qt.ErrorMatches, `cannot encrypt cache entry: no key with the current ID "k2" in the keyring`)
+}
@@ -0,0 +1,83 @@
+package configcatcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// CacheEntryFormatVersion holds the version of the
+	// format written by CacheEntryToBytes.
+	CacheEntryFormatVersion = 3
+
+	// CacheCompressionThreshold holds the size from which
+	// CacheEntryToBytes compresses config JSON bodies.
+	CacheCompressionThreshold = 4 << 10
+)
+
+// envelopeMagic starts every entry in the v3 format or later. Its first
+// byte can't start an entry in the v2 format, which starts with a number.
+const envelopeMagic = "\x89CCE"
+
+const (
+	envelopeHeaderSize = len(envelopeMagic) + 2 + sha256.Size
+	envelopeGzip       = 1 << 0
+)
+
+// CacheEntryToBytes is like CacheSegmentsToBytes except that it
+// serializes the entry in the v3 format, which wraps the v2 format
+// in an envelope that holds a magic header, the format version, a
+// SHA-256 hash of the content and flags. Config JSON bodies of at
+// least CacheCompressionThreshold bytes are compressed with gzip.
+//
+// CacheSegmentsFromBytes reads entries in either format.
+func CacheEntryToBytes(fetchTime time.Time, eTag string, config []byte) []byte {
+	payload := CacheSegmentsToBytes(fetchTime, eTag, config)
+	sum := sha256.Sum256(payload)
+	var flags byte
+	if len(config) >= CacheCompressionThreshold {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		// Note: writes to a bytes.Buffer can't fail.
+		w.Write(payload)
+		w.Close()
+		payload = buf.Bytes()
+		flags |= envelopeGzip
+	}
+	entry := make([]byte, 0, envelopeHeaderSize+len(payload))
+	entry = append(entry, envelopeMagic...)
+	entry = append(entry, CacheEntryFormatVersion, flags)
+	entry = append(entry, sum[:]...)
+	return append(entry, payload...)
+}
+
+// openEnvelope returns the v2 payload of an entry in the v3 format.
+func openEnvelope(entry []byte) ([]byte, error) {
+	if len(entry) < envelopeHeaderSize {
+		return nil, fmt.Errorf("truncated cache entry")
+	}
+	if version := entry[len(envelopeMagic)]; version != CacheEntryFormatVersion {
+		return nil, fmt.Errorf("unsupported cache entry format version %d", version)
+	}
+	flags := entry[len(envelopeMagic)+1]
+	sum := entry[len(envelopeMagic)+2 : envelopeHeaderSize]
+	payload := entry[envelopeHeaderSize:]
+	if flags&envelopeGzip != 0 {
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, fmt.Errorf("invalid compressed cache entry: %v", err)
+		}
+		payload, err = io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid compressed cache entry: %v", err)
+		}
+	}
+	if actual := sha256.Sum256(payload); !bytes.Equal(actual[:], sum) {
+		return nil, fmt.Errorf("cache entry checksum mismatch; the entry is corrupted or truncated")
+	}
+	return payload, nil
+}
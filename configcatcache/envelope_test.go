@@ -0,0 +1,60 @@
+package configcatcache
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCacheEntry_RoundTrip(t *testing.T) {
+	c := qt.New(t)
+	fetchTime := time.UnixMilli(1686756435844)
+	small := testConfigJSON("value")
+	large := testConfigJSON(strings.Repeat("value", CacheCompressionThreshold))
+	for _, config := range [][]byte{small, large} {
+		entry := CacheEntryToBytes(fetchTime, "etag", config)
+		ft, etag, body, err := CacheSegmentsFromBytes(entry)
+		c.Assert(err, qt.IsNil)
+		c.Assert(ft.Equal(fetchTime), qt.IsTrue)
+		c.Assert(etag, qt.Equals, "etag")
+		c.Assert(body, qt.DeepEquals, config)
+	}
+	// Large bodies are compressed.
+	c.Assert(len(CacheEntryToBytes(fetchTime, "etag", large)) < len(large)/10, qt.IsTrue)
+
+	// Entries in the v2 format are still read.
+	ft, etag, body, err := CacheSegmentsFromBytes(CacheSegmentsToBytes(fetchTime, "etag", small))
+	c.Assert(err, qt.IsNil)
+	c.Assert(ft.Equal(fetchTime), qt.IsTrue)
+	c.Assert(etag, qt.Equals, "etag")
+	c.Assert(body, qt.DeepEquals, small)
+}
+
+func TestCacheEntry_Invalid(t *testing.T) {
+	c := qt.New(t)
+	config := testConfigJSON("value")
+	entry := CacheEntryToBytes(time.Now(), "etag", config)
+
+	_, _, _, err := CacheSegmentsFromBytes(entry[:len(entry)-2])
+	c.Assert(err, qt.ErrorMatches, `cache entry checksum mismatch; the entry is corrupted or truncated`)
+	_, _, _, err = CacheSegmentsFromBytes(entry[:10])
+	c.Assert(err, qt.ErrorMatches, `truncated cache entry`)
+
+	corrupted := append([]byte(nil), entry...)
+	corrupted[len(corrupted)-3] ^= 1
+	_, _, _, err = CacheSegmentsFromBytes(corrupted)
+	c.Assert(err, qt.ErrorMatches, `cache entry checksum mismatch; the entry is corrupted or truncated`)
+
+	future := append([]byte(nil), entry...)
+	future[4] = 4
+	_, _, _, err = CacheSegmentsFromBytes(future)
+	c.Assert(err, qt.ErrorMatches, `unsupported cache entry format version 4`)
+}
+
+// testConfigJSON returns a config.json with a
+// single setting holding the given value.
+func testConfigJSON(value string) []byte {
+	return []byte(`{"f":{"key":{"t":1,"v":{"s":"` + value + `"}}}}`)
+}
@@ -0,0 +1,97 @@
+package configcatcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DefaultFileCacheDirPerm holds the permissions the
+	// directory of a FileCache is created with by default.
+	DefaultFileCacheDirPerm fs.FileMode = 0o700
+
+	// DefaultFileCacheFilePerm holds the permissions of
+	// the entry files of a FileCache by default.
+	DefaultFileCacheFilePerm fs.FileMode = 0o600
+)
+
+// FileCache is a ConfigCache that stores each entry in a file
+// in a directory, named after the entry's key (the hash produced
+// by ProduceCacheKey), so that the configuration survives restarts.
+//
+// Entries are written to a temporary file that's then renamed, so
+// readers never see a partially written entry, even when several
+// processes share the directory. When they do, wrapping the cache
+// in a FileLock also elects one of them to fetch the configuration
+// on behalf of the others.
+type FileCache struct {
+	// Dir holds the directory that holds the entries.
+	// It's created when the first entry is written.
+	Dir string
+
+	// DirPerm holds the permissions Dir is created with.
+	// If it's zero, DefaultFileCacheDirPerm is used.
+	DirPerm fs.FileMode
+
+	// FilePerm holds the permissions of the entry files.
+	// If it's zero, DefaultFileCacheFilePerm is used.
+	FilePerm fs.FileMode
+}
+
+// NewFileCache returns a FileCache that stores entries in dir
+// with the default permissions.
+func NewFileCache(dir string) *FileCache {
+	return &FileCache{
+		Dir: dir,
+	}
+}
+
+// Get implements ConfigCache.Get. It returns a nil
+// value when there's no entry for the key.
+func (c *FileCache) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := c.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// Set implements ConfigCache.Set.
+func (c *FileCache) Set(_ context.Context, key string, value []byte) error {
+	path, err := c.path(key)
+	if err != nil {
+		return err
+	}
+	dirPerm := c.DirPerm
+	if dirPerm == 0 {
+		dirPerm = DefaultFileCacheDirPerm
+	}
+	// Note: this also recreates the directory if it's been removed since.
+	if err := os.MkdirAll(c.Dir, dirPerm); err != nil {
+		return err
+	}
+	filePerm := c.FilePerm
+	if filePerm == 0 {
+		filePerm = DefaultFileCacheFilePerm
+	}
+	return writeFileAtomic(path, value, filePerm)
+}
+
+func (c *FileCache) path(key string) (string, error) {
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return "", fmt.Errorf("invalid cache key %q", key)
+	}
+	return filepath.Join(c.Dir, key), nil
+}
@@ -0,0 +1,68 @@
+package configcatcache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestFileCache(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "cache")
+	cache := &FileCache{
+		Dir:      dir,
+		DirPerm:  0o750,
+		FilePerm: 0o640,
+	}
+	key := ProduceCacheKey("sdk-key", ConfigJSONName, ConfigJSONCacheVersion)
+	c.Assert(cache.Set(ctx, key, []byte("value")), qt.IsNil)
+
+	info, err := os.Stat(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0o750))
+	entries, err := os.ReadDir(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].Name(), qt.Equals, key)
+	info, err = entries[0].Info()
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0o640))
+
+	// Another cache using the same directory, as after
+	// a restart, reads the entry.
+	value, err := NewFileCache(dir).Get(ctx, key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(value), qt.Equals, "value")
+
+	c.Assert(cache.Set(ctx, key, []byte("value2")), qt.IsNil)
+	value, err = cache.Get(ctx, key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(value), qt.Equals, "value2")
+}
+
+func TestFileCache_DefaultPerm(t *testing.T) {
+	c := qt.New(t)
+	dir := filepath.Join(t.TempDir(), "cache")
+	c.Assert(NewFileCache(dir).Set(context.Background(), "key", []byte("value")), qt.IsNil)
+	info, err := os.Stat(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, DefaultFileCacheDirPerm)
+	info, err = os.Stat(filepath.Join(dir, "key"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, DefaultFileCacheFilePerm)
+}
+
+func TestFileCache_InvalidKey(t *testing.T) {
+	c := qt.New(t)
+	cache := NewFileCache(t.TempDir())
+	_, err := cache.Get(context.Background(), "../key")
+	c.Assert(err, qt.ErrorMatches, `invalid cache key "\.\./key"`)
+	c.Assert(cache.Set(context.Background(), "", []byte("x")), qt.ErrorMatches, `invalid cache key ""`)
+	value, err := cache.Get(context.Background(), "missing")
+	c.Assert(err, qt.IsNil)
+	c.Assert(value, qt.IsNil)
+}
@@ -0,0 +1,268 @@
+package configcatcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileLock adds the SDK's ConfigCacheLocker interface to a ConfigCache
+// by means of lock files in a directory, so that processes on hosts
+// sharing a volume elect one of them to fetch on behalf of the others.
+//
+// Each lease is held in a file of its own, whose name holds a
+// generation number, and the lock belongs to the owner of the lease
+// with the highest generation. A lease is taken over by creating the
+// file of the next generation exclusively, so exactly one process wins
+// each takeover and the generation acts as a fencing token. The file
+// system holding the directory must support hard links.
+//
+// The holder renews its lease by rewriting its file. A lease expires
+// when its file has been seen unchanged for the lease's duration, as
+// measured by the clock of the process that wants to take it over,
+// so the clocks of the hosts needn't agree. A holder that stalls
+// for longer than that keeps believing it holds the lock until its
+// next call to TryLock, in which case both processes fetch meanwhile.
+type FileLock struct {
+	ConfigCache
+
+	// Dir holds the directory that holds the lock files.
+	Dir string
+
+	mu sync.Mutex
+	// seen holds the lease of each lock as last seen by TryLock.
+	seen map[string]seenLease
+}
+
+// seenLease records a lease held by another owner and
+// the time from which it has been seen unchanged.
+type seenLease struct {
+	generation uint64
+	contents   string
+	since      time.Time
+}
+
+// NewFileLock returns a FileLock that stores entries in
+// cache and lock files in dir, which must exist.
+func NewFileLock(cache ConfigCache, dir string) *FileLock {
+	return &FileLock{
+		ConfigCache: cache,
+		Dir:         dir,
+	}
+}
+
+// TryLock implements ConfigCacheLocker.TryLock.
+func (l *FileLock) TryLock(_ context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	generation, contents, err := l.readLease(key)
+	if err != nil {
+		return false, err
+	}
+	holder, renewals := parseLease(contents)
+	switch {
+	case generation == 0 || holder == "":
+		// Nobody holds the lock.
+	case holder == owner:
+		return l.renew(key, owner, generation, renewals)
+	case !l.expired(key, generation, contents, ttl):
+		return false, nil
+	}
+	// Write the lease aside and link it into place, which fails when
+	// the file exists, so that it never appears partially written.
+	tmp, err := writeTempFile(l.leasePath(key, generation+1), formatLease(owner, 0), 0o644)
+	if err != nil {
+		return false, err
+	}
+	err = os.Link(tmp, l.leasePath(key, generation+1))
+	os.Remove(tmp)
+	if err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			// Another process got there first.
+			return false, nil
+		}
+		return false, err
+	}
+	// The superseded leases aren't needed anymore.
+	l.removeLeases(key, generation+1)
+	return true, nil
+}
+
+// renew extends the lease of the given generation held by owner
+// and reports whether it's still the current one.
+func (l *FileLock) renew(key string, owner string, generation uint64, renewals uint64) (bool, error) {
+	path := l.leasePath(key, generation)
+	if err := writeFileAtomic(path, formatLease(owner, renewals+1), 0o644); err != nil {
+		return false, err
+	}
+	// The lease may have been taken over in the meantime.
+	current, _, err := l.readLease(key)
+	if err != nil {
+		return false, err
+	}
+	if current != generation {
+		os.Remove(path)
+		return false, nil
+	}
+	return true, nil
+}
+
+// expired reports whether the lease of the given generation and
+// contents has been seen unchanged for at least ttl.
+func (l *FileLock) expired(key string, generation uint64, contents string, ttl time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	seen, ok := l.seen[key]
+	if !ok || seen.generation != generation || seen.contents != contents {
+		if l.seen == nil {
+			l.seen = make(map[string]seenLease)
+		}
+		l.seen[key] = seenLease{
+			generation: generation,
+			contents:   contents,
+			since:      now,
+		}
+		return false
+	}
+	return now.Sub(seen.since) >= ttl
+}
+
+// Unlock implements ConfigCacheLocker.Unlock.
+func (l *FileLock) Unlock(_ context.Context, key string, owner string) error {
+	generation, contents, err := l.readLease(key)
+	if err != nil || generation == 0 {
+		return err
+	}
+	if holder, _ := parseLease(contents); holder != owner {
+		return nil
+	}
+	// Keep the file so that the next lease gets the next generation.
+	return writeFileAtomic(l.leasePath(key, generation), nil, 0o644)
+}
+
+// readLease returns the generation and contents of the current
+// lease of the lock with the given key. The generation is zero
+// when there's no lease.
+func (l *FileLock) readLease(key string) (generation uint64, contents string, err error) {
+	for {
+		generations, err := l.leaseGenerations(key)
+		if err != nil || len(generations) == 0 {
+			return 0, "", err
+		}
+		generation = generations[len(generations)-1]
+		data, err := os.ReadFile(l.leasePath(key, generation))
+		if err == nil {
+			return generation, string(data), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return 0, "", err
+		}
+		// The lease has just been superseded and removed.
+	}
+}
+
+// leaseGenerations returns the generations of the lease
+// files of the lock with the given key in increasing order.
+func (l *FileLock) leaseGenerations(key string) ([]uint64, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := key + ".lock."
+	var generations []uint64
+	for _, entry := range entries {
+		suffix := strings.TrimPrefix(entry.Name(), prefix)
+		if len(suffix) == len(entry.Name()) {
+			continue
+		}
+		if generation, err := strconv.ParseUint(suffix, 10, 64); err == nil && generation > 0 {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i] < generations[j]
+	})
+	return generations, nil
+}
+
+// removeLeases removes the lease files of the lock with
+// the given key that are older than the given generation.
+func (l *FileLock) removeLeases(key string, generation uint64) {
+	generations, _ := l.leaseGenerations(key)
+	for _, g := range generations {
+		if g < generation {
+			os.Remove(l.leasePath(key, g))
+		}
+	}
+}
+
+func (l *FileLock) leasePath(key string, generation uint64) string {
+	return filepath.Join(l.Dir, key+".lock."+strconv.FormatUint(generation, 10))
+}
+
+// formatLease returns the contents of a lease file
+// held by owner that has been renewed the given
+// number of times.
+func formatLease(owner string, renewals uint64) []byte {
+	return []byte(owner + "\n" + strconv.FormatUint(renewals, 10))
+}
+
+// parseLease parses the contents of a lease file. The
+// owner is empty when the lease has been released.
+func parseLease(contents string) (owner string, renewals uint64) {
+	owner, renewalsText, ok := strings.Cut(contents, "\n")
+	if !ok {
+		// The lease has been released.
+		return "", 0
+	}
+	renewals, _ = strconv.ParseUint(renewalsText, 10, 64)
+	return owner, renewals
+}
+
+// writeFileAtomic writes data to a temporary file in the same
+// directory as path and renames it to path, so that readers
+// never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTempFile(path, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot replace %s: %v", path, err)
+	}
+	return nil
+}
+
+// writeTempFile writes data to a new temporary file in the
+// same directory as path and returns the name of the file.
+func writeTempFile(path string, data []byte, perm os.FileMode) (_ string, err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return f.Name(), nil
+}
@@ -0,0 +1,92 @@
+package configcatcache
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryCache is a ConfigCache that holds entries in memory.
+// It also implements the SDK's ConfigCacheExt interface. Wrap it
+// in a MemoryLock to have the clients sharing it elect one of them
+// to fetch on behalf of the others.
+//
+// The zero value is ready to use.
+type MemoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value []byte
+	// expires holds when the entry expires; zero means never.
+	expires time.Time
+}
+
+// NewMemoryCache returns a new, empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{}
+}
+
+// Get implements ConfigCache.Get. It returns a nil
+// value when there's no entry for the key.
+func (c *MemoryCache) Get(_ context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key), nil
+}
+
+// Set implements ConfigCache.Set.
+func (c *MemoryCache) Set(_ context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value, 0)
+	return nil
+}
+
+// Delete removes the entry with the given key, if any.
+func (c *MemoryCache) Delete(_ context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+// CompareAndSet implements ConfigCacheExt.CompareAndSet.
+func (c *MemoryCache) CompareAndSet(_ context.Context, key string, value []byte, expected []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Note: an entry is never empty, so an empty
+	// expected value only matches a missing entry.
+	if !bytes.Equal(c.get(key), expected) {
+		return false, nil
+	}
+	c.set(key, value, ttl)
+	return true, nil
+}
+
+// get must be called with c.mu held.
+func (c *MemoryCache) get(key string) []byte {
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !entry.expires.IsZero() && !time.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.value
+}
+
+// set must be called with c.mu held.
+func (c *MemoryCache) set(key string, value []byte, ttl time.Duration) {
+	if c.entries == nil {
+		c.entries = make(map[string]memoryEntry)
+	}
+	entry := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	c.entries[key] = entry
+}
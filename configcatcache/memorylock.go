@@ -0,0 +1,55 @@
+package configcatcache
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryLock adds the SDK's ConfigCacheLocker interface to a
+// ConfigCache by means of locks held in memory, so that the clients
+// sharing it in a process (typically in tests) elect one of them to
+// fetch on behalf of the others.
+type MemoryLock struct {
+	ConfigCache
+
+	mu    sync.Mutex
+	locks map[string]memoryLock
+}
+
+type memoryLock struct {
+	owner   string
+	expires time.Time
+}
+
+// NewMemoryLock returns a MemoryLock that stores entries in cache.
+func NewMemoryLock(cache ConfigCache) *MemoryLock {
+	return &MemoryLock{
+		ConfigCache: cache,
+	}
+}
+
+// TryLock implements ConfigCacheLocker.TryLock.
+func (l *MemoryLock) TryLock(_ context.Context, key string, owner string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if lock, ok := l.locks[key]; ok && lock.owner != owner && now.Before(lock.expires) {
+		return false, nil
+	}
+	if l.locks == nil {
+		l.locks = make(map[string]memoryLock)
+	}
+	l.locks[key] = memoryLock{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// Unlock implements ConfigCacheLocker.Unlock.
+func (l *MemoryLock) Unlock(_ context.Context, key string, owner string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lock, ok := l.locks[key]; ok && lock.owner == owner {
+		delete(l.locks, key)
+	}
+	return nil
+}
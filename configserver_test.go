@@ -21,6 +21,7 @@ type configServer struct {
 
 	mu           sync.Mutex
 	resp         *configResponse
+	queue        []configResponse
 	responses    []configResponse
 	requestCount int
 }
@@ -28,6 +29,7 @@ type configServer struct {
 type configResponse struct {
 	status int
 	body   string
+	header http.Header
 	sleep  time.Duration
 }
 
@@ -70,6 +72,14 @@ func (srv *configServer) setResponse(response configResponse) {
 	srv.resp = &response
 }
 
+// queueResponses sets responses that will be returned, in order,
+// before falling back to the response set by setResponse.
+func (srv *configServer) queueResponses(responses ...configResponse) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.queue = append(srv.queue, responses...)
+}
+
 func (srv *configServer) setResponseJSON(x interface{}) {
 	srv.setResponse(configResponse{
 		body: marshalJSON(x),
@@ -99,6 +109,10 @@ func (srv *configServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	srv.mu.Lock()
 	srv.requestCount++
 	resp0 := srv.resp
+	if len(srv.queue) > 0 {
+		resp0 = &srv.queue[0]
+		srv.queue = srv.queue[1:]
+	}
 	defer srv.mu.Unlock()
 	if resp0 == nil {
 		srv.t.Errorf("HTTP call with no response provided")
@@ -107,6 +121,9 @@ func (srv *configServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	resp := *resp0
 	time.Sleep(resp.sleep)
+	for key, values := range resp.header {
+		w.Header()[key] = values
+	}
 	if resp.status == 0 {
 		w.Header().Set("Etag", etagOf(resp.body))
 		if req.Header.Get("If-None-Match") == etagOf(resp.body) {
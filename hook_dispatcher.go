@@ -0,0 +1,247 @@
+package configcat
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+const (
+	// DefaultHookQueueSize is the default value of Config.HookQueueSize.
+	DefaultHookQueueSize = 1024
+
+	// DefaultHookSampleRate is the default value of Config.HookSampleRate.
+	DefaultHookSampleRate = 100
+)
+
+// HookOverflow describes what happens to an OnFlagEvaluated call
+// when the hook queue (see Config.HookQueueSize) is full. The calls
+// to the other hooks are never dropped and don't count toward the
+// size of the queue.
+type HookOverflow int
+
+const (
+	// HookOverflowDrop drops the call.
+	HookOverflowDrop HookOverflow = iota
+
+	// HookOverflowBlock makes the flag evaluation
+	// wait for room in the queue. Note that a hook
+	// that evaluates flags with the same client
+	// then blocks forever if the queue is full.
+	HookOverflowBlock
+
+	// HookOverflowSample waits for room in the queue for one
+	// in Config.HookSampleRate of the calls that don't fit
+	// and drops the others. The same caveat as for
+	// HookOverflowBlock applies.
+	HookOverflowSample
+)
+
+// hookDispatcher calls hooks in order from a single goroutine.
+// The OnFlagEvaluated calls are buffered in a bounded queue;
+// the others are always queued.
+type hookDispatcher struct {
+	overflow   HookOverflow
+	sampleRate int
+	size       int
+
+	// inline is set for a dispatcher that calls hooks synchronously.
+	inline bool
+
+	startOnce sync.Once
+	done      chan struct{}
+
+	// mu guards the fields below. cond is signaled
+	// when a call is queued or taken from the queue
+	// and when the dispatcher is closed.
+	mu   sync.Mutex
+	cond *sync.Cond
+	// queue holds the calls waiting to be made, of which
+	// evaluations are OnFlagEvaluated calls.
+	queue       []hookCall
+	evaluations int
+	// overflowed counts the evaluation calls that didn't fit in the
+	// queue and dropped counts those of them that were dropped.
+	overflowed uint64
+	dropped    uint64
+	closed     bool
+	// goroutine holds the ID of the dispatcher goroutine.
+	goroutine uint64
+}
+
+type hookCall struct {
+	f          func()
+	evaluation bool
+}
+
+func newHookDispatcher(cfg Config) *hookDispatcher {
+	size := cfg.HookQueueSize
+	if size < 1 {
+		size = DefaultHookQueueSize
+	}
+	sampleRate := cfg.HookSampleRate
+	if sampleRate < 1 {
+		sampleRate = DefaultHookSampleRate
+	}
+	d := &hookDispatcher{
+		overflow:   cfg.HookOverflow,
+		sampleRate: sampleRate,
+		size:       size,
+		done:       make(chan struct{}),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// dispatch queues a call to f, which calls a hook other than
+// OnFlagEvaluated. When d is nil or has been closed, it calls f
+// in a new goroutine instead.
+func (d *hookDispatcher) dispatch(f func()) {
+	d.queueCall(hookCall{f: f})
+}
+
+// dispatchEvaluation is like dispatch, but for a call to
+// OnFlagEvaluated, so that the call is subject to the
+// overflow policy when the queue is full. Evaluations made
+// with a closed client are still reported.
+func (d *hookDispatcher) dispatchEvaluation(f func()) {
+	d.queueCall(hookCall{f: f, evaluation: true})
+}
+
+func (d *hookDispatcher) queueCall(call hookCall) {
+	if d == nil {
+		go call.f()
+		return
+	}
+	if d.inline {
+		call.f()
+		return
+	}
+	d.startOnce.Do(func() {
+		go d.run()
+	})
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if call.evaluation && !d.closed && d.evaluations >= d.size {
+		if !d.blockOnOverflow() {
+			d.dropped++
+			return
+		}
+		// Wait releases d.mu, so the dispatcher can be closed meanwhile.
+		for !d.closed && d.evaluations >= d.size {
+			d.cond.Wait()
+		}
+	}
+	if d.closed {
+		go call.f()
+		return
+	}
+	d.queue = append(d.queue, call)
+	if call.evaluation {
+		d.evaluations++
+	}
+	d.cond.Broadcast()
+}
+
+// blockOnOverflow reports whether an evaluation call that
+// doesn't fit in the queue should wait for room. It must be
+// called with d.mu held.
+func (d *hookDispatcher) blockOnOverflow() bool {
+	switch d.overflow {
+	case HookOverflowBlock:
+		return true
+	case HookOverflowSample:
+		d.overflowed++
+		return (d.overflowed-1)%uint64(d.sampleRate) == 0
+	}
+	return false
+}
+
+// droppedCalls returns the number of OnFlagEvaluated
+// calls that have been dropped because the queue was full.
+func (d *hookDispatcher) droppedCalls() uint64 {
+	if d == nil {
+		return 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dropped
+}
+
+func (d *hookDispatcher) run() {
+	defer close(d.done)
+	d.mu.Lock()
+	d.goroutine = goroutineID()
+	d.mu.Unlock()
+	for {
+		d.mu.Lock()
+		for len(d.queue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.queue) == 0 {
+			d.mu.Unlock()
+			return
+		}
+		call := d.queue[0]
+		d.queue[0] = hookCall{}
+		d.queue = d.queue[1:]
+		if call.evaluation {
+			d.evaluations--
+		}
+		d.cond.Broadcast()
+		d.mu.Unlock()
+		call.f()
+	}
+}
+
+// goroutineID returns the ID of the calling goroutine, as
+// found at the start of its stack trace ("goroutine 42 [...").
+func goroutineID() uint64 {
+	var buf [64]byte
+	stack := buf[:runtime.Stack(buf[:], false)]
+	stack = bytes.TrimPrefix(stack, []byte("goroutine "))
+	if i := bytes.IndexByte(stack, ' '); i >= 0 {
+		stack = stack[:i]
+	}
+	id, _ := strconv.ParseUint(string(stack), 10, 64)
+	return id
+}
+
+// close makes all the calls queued so far and waits for them
+// to complete. Any later calls are made in new goroutines.
+func (d *hookDispatcher) close() {
+	_ = d.closeContext(context.Background())
+}
+
+// closeContext is like close except that it stops waiting
+// and returns the context's error when ctx is done first.
+// The queued calls are still made in the background.
+//
+// When it's called from a hook, typically because the hook
+// closes the client, it doesn't wait, as the hook would then
+// wait for itself.
+func (d *hookDispatcher) closeContext(ctx context.Context) error {
+	if d == nil || d.inline {
+		return nil
+	}
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	fromHook := d.goroutine != 0 && d.goroutine == goroutineID()
+	d.mu.Unlock()
+	if fromHook {
+		return nil
+	}
+	d.startOnce.Do(func() {
+		go d.run()
+	})
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for hook calls to be delivered: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,164 @@
+package configcat
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestHookDispatcher_ClientFlushesOnClose(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	root := &ConfigJson{Settings: map[string]*Setting{}}
+	for i := 0; i < 10; i++ {
+		root.Settings[fmt.Sprint("key", i)] = &Setting{Type: IntSetting, Value: &SettingValue{Value: i}}
+	}
+	srv.setResponseJSON(root)
+	var mu sync.Mutex
+	var keys []string
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.HookOverflow = HookOverflowBlock
+	cfg.HookQueueSize = 2
+	cfg.Hooks = &Hooks{OnFlagEvaluated: func(details *EvaluationDetails) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, details.Data.Key)
+	}}
+	client := NewCustomClient(cfg)
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	var want []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint("key", i)
+		c.Assert(client.GetIntValue(key, -1, nil), qt.Equals, i)
+		want = append(want, key)
+	}
+	client.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(keys, qt.DeepEquals, want)
+}
+
+func TestHookDispatcher_Ordered(t *testing.T) {
+	c := qt.New(t)
+	var got []int
+	d := newHookDispatcher(Config{HookOverflow: HookOverflowBlock, HookQueueSize: 2})
+	for i := 0; i < 100; i++ {
+		i := i
+		d.dispatch(func() { got = append(got, i) })
+	}
+	d.close()
+	c.Assert(got, qt.HasLen, 100)
+	for i, n := range got {
+		c.Assert(n, qt.Equals, i)
+	}
+	// Calls after closing are still made.
+	called := make(chan struct{})
+	d.dispatch(func() { close(called) })
+	<-called
+	d.close()
+}
+
+func TestHookDispatcher_Drop(t *testing.T) {
+	c := qt.New(t)
+	d := newHookDispatcher(Config{HookQueueSize: 1})
+	unblock := make(chan struct{})
+	started := make(chan struct{})
+	d.dispatch(func() {
+		close(started)
+		<-unblock
+	})
+	<-started
+	calls := 0
+	for i := 0; i < 100; i++ {
+		d.dispatchEvaluation(func() { calls++ })
+	}
+	// The calls to the other hooks are never dropped.
+	lifecycleCalls := 0
+	for i := 0; i < 10; i++ {
+		d.dispatch(func() { lifecycleCalls++ })
+	}
+	close(unblock)
+	d.close()
+	// Only the evaluation that fitted in the queue was reported.
+	c.Assert(calls, qt.Equals, 1)
+	c.Assert(lifecycleCalls, qt.Equals, 10)
+	c.Assert(d.droppedCalls(), qt.Equals, uint64(99))
+}
+
+func TestHookDispatcher_CloseFromHook(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	closed := make(chan struct{})
+	var client *Client
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Hooks = &Hooks{OnConfigChanged: func() {
+		client.Close()
+		close(closed)
+	}}
+	client = NewCustomClient(cfg)
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		c.Fatalf("closing the client from a hook didn't return")
+	}
+	c.Assert(client.Refresh(context.Background()), qt.Equals, ErrClientClosed)
+}
+
+func TestGoroutineID(t *testing.T) {
+	c := qt.New(t)
+	id := goroutineID()
+	c.Assert(id, qt.Not(qt.Equals), uint64(0))
+	c.Assert(goroutineID(), qt.Equals, id)
+	other := make(chan uint64)
+	go func() {
+		other <- goroutineID()
+	}()
+	c.Assert(<-other, qt.Not(qt.Equals), id)
+}
+
+func TestHookDispatcher_Sample(t *testing.T) {
+	c := qt.New(t)
+	d := newHookDispatcher(Config{HookOverflow: HookOverflowSample, HookSampleRate: 10})
+	sampled := 0
+	for i := 0; i < 30; i++ {
+		if d.blockOnOverflow() {
+			sampled++
+		}
+	}
+	c.Assert(sampled, qt.Equals, 3)
+}
+
+func TestHookDispatcher_CloseWhileBlocked(t *testing.T) {
+	c := qt.New(t)
+	d := newHookDispatcher(Config{HookOverflow: HookOverflowBlock, HookQueueSize: 1})
+	unblock := make(chan struct{})
+	started := make(chan struct{})
+	d.dispatch(func() {
+		close(started)
+		<-unblock
+	})
+	<-started
+	d.dispatchEvaluation(func() {})
+	// The queue is full, so the next evaluation waits for room.
+	called := make(chan struct{})
+	go d.dispatchEvaluation(func() { close(called) })
+	closed := make(chan struct{})
+	go func() {
+		d.close()
+		close(closed)
+	}()
+	// Closing doesn't wait for the blocked evaluation, which is
+	// then made in a goroutine of its own.
+	<-called
+	close(unblock)
+	<-closed
+	c.Assert(d.droppedCalls(), qt.Equals, uint64(0))
+}
@@ -77,8 +77,11 @@ func (log *leveledLogger) Warnf(eventId int, format string, args ...interface{})
 }
 
 func (log *leveledLogger) Errorf(eventId int, format string, args ...interface{}) {
-	if log.hooks != nil && log.hooks.OnError != nil {
-		go log.hooks.OnError(fmt.Errorf(format, args...))
+	if hooks := log.hooks; hooks != nil && hooks.OnError != nil {
+		err := fmt.Errorf(format, args...)
+		hooks.dispatch(func() {
+			hooks.OnError(err)
+		})
 	}
 	if log.enabled(LogLevelError) {
 		log.Logger.Errorf("["+strconv.Itoa(eventId)+"] "+format, args...)
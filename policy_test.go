@@ -22,6 +22,7 @@ func TestFetchFailWithCacheFallback(t *testing.T) {
 	// First use a client to populate the cache.
 	cfg := srv.config()
 	cfg.PollInterval = 10 * time.Millisecond
+	cfg.RetryPolicy = &RetryPolicy{MaxAttempts: 1}
 
 	cache := &customCache{
 		items: map[string]string{},
@@ -92,6 +93,168 @@ func TestFetchFailWithCacheFallback(t *testing.T) {
 	}
 }
 
+func TestCacheFirstRefresh(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{body: `{"test":1}`})
+	cache := &customCache{
+		items: map[string]string{},
+	}
+	cfg := srv.config()
+	cfg.Cache = cache
+	cfg.PollInterval = time.Minute
+
+	client1 := NewCustomClient(cfg)
+	defer client1.Close()
+	<-client1.Ready()
+	c.Assert(client1.fetcher.current().body(), qt.Equals, `{"test":1}`)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+
+	// A second instance sharing the cache uses the cached
+	// configuration because it's younger than the poll interval.
+	client2 := NewCustomClient(cfg)
+	defer client2.Close()
+	<-client2.Ready()
+	c.Assert(client2.fetcher.current().body(), qt.Equals, `{"test":1}`)
+	c.Assert(client2.fetcher.current().fetchTime.UnixMilli(), qt.Equals, client1.fetcher.current().fetchTime.UnixMilli())
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+
+	// An explicit refresh always goes to the server
+	// and writes the result through to the cache.
+	srv.setResponse(configResponse{body: `{"test":2}`})
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client2.fetcher.current().body(), qt.Equals, `{"test":2}`)
+	c.Assert(srv.allResponses(), qt.HasLen, 2)
+	for key := range cache.allItems() {
+		cached, _ := cache.Get(context.Background(), key)
+		_, _, b, _ := configcatcache.CacheSegmentsFromBytes(cached)
+		c.Assert(string(b), qt.Equals, `{"test":2}`)
+	}
+}
+
+func TestCacheFirstRefresh_StaleEntry(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{body: `{"test":2}`})
+	cfg := srv.config()
+	cfg.PollInterval = time.Minute
+	cfg.Cache = &simpleCache{
+		entry: configcatcache.CacheSegmentsToBytes(time.Now().Add(-2*time.Minute), "etag", []byte(`{"test":1}`)),
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	<-client.Ready()
+	c.Assert(client.fetcher.current().body(), qt.Equals, `{"test":2}`)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+}
+
+func TestCacheFirstRefresh_RefreshJoiningPoll(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{body: `{"test":2}`})
+	cache := &gatedCache{
+		release: make(chan struct{}),
+	}
+	cache.entry = configcatcache.CacheSegmentsToBytes(time.Now(), "etag", []byte(`{"test":1}`))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.Cache = cache
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	f := client.fetcher.(*configFetcher)
+
+	// The poll is satisfied by the cached configuration,
+	// but a refresh that joins it must not be.
+	_ = f.poll(time.Minute, false)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Refresh(context.Background())
+	}()
+	waitFor(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.inflight != nil && f.inflight.waiters == 1
+	})
+	close(cache.release)
+	c.Assert(<-done, qt.IsNil)
+	c.Assert(f.current().body(), qt.Equals, `{"test":2}`)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+}
+
+func TestCacheFirstRefresh_RefreshJoiningFailedPoll(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{
+		status: http.StatusForbidden,
+		sleep:  50 * time.Millisecond,
+	})
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	f := client.fetcher.(*configFetcher)
+
+	// The refresh would not be satisfied by the poll's
+	// result, but when the poll fails it gets the error
+	// rather than trying again.
+	_ = f.poll(time.Minute, false)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Refresh(context.Background())
+	}()
+	waitFor(t, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.inflight != nil && f.inflight.waiters == 1
+	})
+	c.Assert(<-done, qt.ErrorMatches, `config fetch failed: .*`)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+}
+
+func TestStartFromCache(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{
+		body:  `{"test":2}`,
+		sleep: 50 * time.Millisecond,
+	})
+	cfg := srv.config()
+	cfg.PollInterval = time.Minute
+	cfg.StartFromCache = true
+	cfg.Cache = &simpleCache{
+		entry: configcatcache.CacheSegmentsToBytes(time.Now().Add(-2*time.Minute), "etag", []byte(`{"test":1}`)),
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	select {
+	case <-client.Ready():
+	default:
+		t.Fatalf("client not ready after starting from the cache")
+	}
+	c.Assert(client.fetcher.current().body(), qt.Equals, `{"test":1}`)
+
+	// The stale cached configuration is refreshed in the background.
+	waitFor(t, func() bool {
+		return client.fetcher.current().body() == `{"test":2}`
+	})
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+}
+
+func TestStartFromCache_EmptyCache(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{body: `{"test":1}`})
+	cfg := srv.config()
+	cfg.StartFromCache = true
+	cfg.Cache = &simpleCache{}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	<-client.Ready()
+	c.Assert(client.fetcher.current().body(), qt.Equals, `{"test":1}`)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+}
+
 func Test_Consistent_Cache(t *testing.T) {
 	c := qt.New(t)
 	cacheEntry := `1686756435844
@@ -124,6 +287,17 @@ test-etag
 	c.Assert(string(serialized), qt.Equals, cacheEntry)
 }
 
+// gatedCache is a simpleCache whose Get blocks until release is closed.
+type gatedCache struct {
+	simpleCache
+	release chan struct{}
+}
+
+func (g *gatedCache) Get(ctx context.Context, key string) ([]byte, error) {
+	<-g.release
+	return g.simpleCache.Get(ctx, key)
+}
+
 type simpleCache struct {
 	mu    sync.Mutex
 	entry []byte
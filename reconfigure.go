@@ -0,0 +1,224 @@
+package configcat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/configcat/go-sdk/v9/configcatcache"
+	"time"
+)
+
+// ReconfigureOptions holds the settings changed by Client.Reconfigure.
+// Fields left as their zero value leave the corresponding setting unchanged.
+type ReconfigureOptions struct {
+	// SDKKey holds the new SDK key.
+	SDKKey string
+
+	// PollingMode holds the new polling mode.
+	PollingMode *PollingMode
+
+	// PollInterval holds the new poll interval.
+	PollInterval time.Duration
+
+	// BaseURL holds the new base URL (see Config.BaseURL).
+	BaseURL string
+
+	// BaseURLs holds the new base URLs (see Config.BaseURLs).
+	// When this is non-empty, BaseURL is ignored.
+	BaseURLs []string
+}
+
+// Reconfigure changes the SDK key, polling mode, poll interval
+// or base URLs of the client while it's in use.
+//
+// When the SDK key changes, Reconfigure retrieves the configuration
+// for the new key before switching to it. The client keeps using the
+// current key and configuration until then, and also when that fails,
+// in which case Reconfigure returns the error and changes nothing.
+//
+// The poller or streamer is restarted with the new polling mode and
+// poll interval. If ctx is done while Reconfigure waits for it to stop
+// or for a fetch in progress to complete, the settings stay unchanged
+// and the context's error is returned. New base URLs take effect from
+// the next fetch, which starts from the first of them.
+//
+// Reconfigure returns an error without changing anything for a client
+// that shares its fetcher with other clients (see Config.ShareFetcher),
+// because the change would affect all of them, and for a client that
+// was created with an invalid SDK key. Create a new client instead.
+func (client *Client) Reconfigure(ctx context.Context, opts ReconfigureOptions) error {
+	if client.isClosed() {
+		return ErrClientClosed
+	}
+	f, ok := client.fetcher.(*configFetcher)
+	if !ok {
+		return errors.New("cannot reconfigure a client that shares its fetcher or has an invalid SDK key")
+	}
+	client.reconfigureMu.Lock()
+	defer client.reconfigureMu.Unlock()
+
+	polling := client.pollingState()
+	mode, pollInterval := polling.mode, polling.interval
+	if opts.PollingMode != nil {
+		mode = *opts.PollingMode
+	}
+	if opts.PollInterval > 0 {
+		pollInterval = opts.PollInterval
+	}
+	var endpoints []*endpoint
+	urlIsCustom := f.urlIsCustom
+	if opts.BaseURL != "" || len(opts.BaseURLs) > 0 {
+		endpoints, urlIsCustom = newEndpoints(Config{BaseURL: opts.BaseURL, BaseURLs: opts.BaseURLs})
+	}
+	sdkKey := opts.SDKKey
+	if sdkKey == f.sdkKey {
+		sdkKey = ""
+	}
+	if sdkKey != "" && !isValidSdkKey(sdkKey, urlIsCustom) {
+		return fmt.Errorf("SDK Key '%s' is invalid", sdkKey)
+	}
+	if err := f.reconfigure(ctx, sdkKey, endpoints, polling.mode, mode, pollInterval); err != nil {
+		return err
+	}
+	client.polling.Store(newPollingState(mode, pollInterval, client.cfg.NoWaitForRefresh))
+	return nil
+}
+
+// reconfigure switches the fetcher to the given SDK key and
+// endpoints, unless they're empty, and restarts the poller or
+// streamer for the new polling mode and interval. oldMode holds
+// the polling mode in use.
+func (f *configFetcher) reconfigure(ctx context.Context, sdkKey string, endpoints []*endpoint, oldMode, mode PollingMode, pollInterval time.Duration) error {
+	var next *configFetcher
+	var nextConfig *config
+	if sdkKey != "" {
+		// Retrieve the new key's configuration without
+		// disturbing the current one.
+		next = f.withSDKKey(sdkKey, endpoints)
+		config, err := next.fetchConfig(ctx, nil, time.Now().Add(-pollInterval))
+		if err == nil && config == nil {
+			err = errors.New("no configuration available")
+		}
+		if err != nil {
+			var fErr *fetcherError
+			if errors.As(err, &fErr) {
+				f.logger.Errorf(fErr.EventId, "config fetch for the new SDK key failed: %v", fErr.Err)
+			} else {
+				f.logger.Errorf(0, "config fetch for the new SDK key failed: %v", err)
+			}
+			return fmt.Errorf("config fetch for the new SDK key failed: %v", err)
+		}
+		if err := f.approve(config, f.current()); err != nil {
+			return fmt.Errorf("config fetch for the new SDK key failed: %v", err)
+		}
+		nextConfig = config
+	}
+	if err := f.stopPoller(ctx); err != nil {
+		f.startPoller(oldMode, f.pollInterval)
+		return err
+	}
+	// Wait until no fetch is in progress so that
+	// the key-dependent state is ours to change.
+	f.mu.Lock()
+	for f.inflight != nil {
+		done := f.inflight.done
+		f.mu.Unlock()
+		select {
+		case err := <-done:
+			done <- err
+		case <-ctx.Done():
+			f.startPoller(oldMode, f.pollInterval)
+			return ctx.Err()
+		}
+		f.mu.Lock()
+	}
+	if f.closed {
+		f.mu.Unlock()
+		return ErrClientClosed
+	}
+	if next != nil {
+		f.swapKey(next)
+		f.apply(nextConfig, f.current())
+		if f.lockHeld {
+			// next now holds the lock key of the previous SDK key.
+			if err := f.locker.Unlock(ctx, next.lockKey, f.lockOwner); err != nil {
+				f.logger.Errorf(0, "error occurred while releasing the cache lock: %v", err)
+			}
+			f.lockHeld = false
+		}
+		f.logger.Infof(0, "switched to a new SDK key")
+	} else if endpoints != nil {
+		f.endpoints, f.endpointIndex = endpoints, 0
+		f.baseURL = f.endpoints[0].current
+	}
+	if endpoints != nil {
+		f.urlIsCustom = true
+	}
+	f.pollInterval = pollInterval
+	f.pollingIdentifier = pollingModeToIdentifier(mode)
+	if f.locker != nil {
+		f.lockTTL = 2 * pollInterval
+	}
+	f.mu.Unlock()
+	if mode == AutoPoll || mode == Streaming {
+		_ = f.poll(pollInterval, false)
+	}
+	f.startPoller(mode, pollInterval)
+	return nil
+}
+
+// withSDKKey returns a fetcher like f, but for the given SDK key,
+// that's only used to fetch the key's first configuration. It
+// doesn't use the cache lock and starts from the given endpoints
+// or, when there are none, the configured base URLs.
+func (f *configFetcher) withSDKKey(sdkKey string, endpoints []*endpoint) *configFetcher {
+	next := &configFetcher{
+		sdkKey:                 sdkKey,
+		cacheKey:               configcatcache.ProduceCacheKey(sdkKey, configcatcache.ConfigJSONName, configcatcache.ConfigJSONCacheVersion),
+		cache:                  f.cache,
+		cacheExt:               f.cacheExt,
+		cacheTTL:               f.cacheTTL,
+		checksummedCache:       f.checksummedCache,
+		logger:                 f.logger,
+		client:                 f.client,
+		urlIsCustom:            f.urlIsCustom || endpoints != nil,
+		defaultUser:            f.defaultUser,
+		pollingIdentifier:      f.pollingIdentifier,
+		overrides:              f.overrides,
+		hooks:                  f.hooks,
+		timeout:                f.timeout,
+		retryPolicy:            f.retryPolicy,
+		source:                 f.source,
+		ctx:                    f.ctx,
+		preferredRetryInterval: f.preferredRetryInterval,
+	}
+	if f.isOffline() {
+		// Read the cache rather than probing the CDN.
+		next.offline = modeOffline
+	}
+	if f.locker != nil {
+		next.lockKey = next.cacheKey + "_lock"
+	}
+	next.endpoints = endpoints
+	if next.endpoints == nil {
+		for _, ep := range f.endpoints {
+			next.endpoints = append(next.endpoints, &endpoint{url: ep.url, current: ep.url})
+		}
+	}
+	next.baseURL = next.endpoints[0].current
+	return next
+}
+
+// swapKey exchanges the state that depends on the SDK
+// key between f and other. It must be called with f.mu
+// held and no fetch in progress.
+func (f *configFetcher) swapKey(other *configFetcher) {
+	f.sdkKey, other.sdkKey = other.sdkKey, f.sdkKey
+	f.cacheKey, other.cacheKey = other.cacheKey, f.cacheKey
+	f.lockKey, other.lockKey = other.lockKey, f.lockKey
+	f.cacheEntry, other.cacheEntry = other.cacheEntry, f.cacheEntry
+	f.endpoints, other.endpoints = other.endpoints, f.endpoints
+	f.endpointIndex, other.endpointIndex = other.endpointIndex, f.endpointIndex
+	f.baseURL = f.endpoints[f.endpointIndex].current
+	other.baseURL = other.endpoints[other.endpointIndex].current
+}
@@ -0,0 +1,137 @@
+package configcat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_Reconfigure_SDKKey(t *testing.T) {
+	c := qt.New(t)
+	srv := newMultiKeyServer(t)
+	key1, key2, key3 := randomSdkKey(), randomSdkKey(), randomSdkKey()
+	srv.set(key1, marshalJSON(rootNodeWithKeyValue("key", "value1")))
+	srv.set(key2, marshalJSON(rootNodeWithKeyValue("key", "value2")))
+	cache := &customCache{items: make(map[string]string)}
+	client := NewCustomClient(Config{
+		SDKKey:      key1,
+		BaseURL:     srv.srv.URL,
+		PollingMode: Manual,
+		Cache:       cache,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelNone,
+	})
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	// The current configuration stays in use when the
+	// configuration for the new key can't be retrieved.
+	err := client.Reconfigure(context.Background(), ReconfigureOptions{SDKKey: key3})
+	c.Assert(err, qt.ErrorMatches, `config fetch for the new SDK key failed: your SDK Key seems to be wrong.*`)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+	err = client.Reconfigure(context.Background(), ReconfigureOptions{SDKKey: "invalid"})
+	c.Assert(err, qt.ErrorMatches, `SDK Key 'invalid' is invalid`)
+
+	c.Assert(client.Reconfigure(context.Background(), ReconfigureOptions{SDKKey: key2}), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2")
+	c.Assert(srv.requestCount(key2), qt.Equals, 1)
+	c.Assert(cache.items, qt.HasLen, 2)
+
+	// Subsequent fetches use the new key.
+	srv.set(key2, marshalJSON(rootNodeWithKeyValue("key", "value2b")))
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2b")
+	c.Assert(srv.requestCount(key1), qt.Equals, 1)
+}
+
+func TestClient_Reconfigure_PollInterval(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value1"))
+	cfg := srv.config()
+	cfg.PollInterval = time.Hour
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	err := client.Reconfigure(context.Background(), ReconfigureOptions{PollInterval: 20 * time.Millisecond})
+	c.Assert(err, qt.IsNil)
+	waitFor(t, func() bool {
+		return client.GetStringValue("key", "", nil) == "value2"
+	})
+}
+
+func TestClient_Reconfigure_PollingMode(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value1"))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.PollInterval = 20 * time.Millisecond
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "")
+
+	// Switching to AutoPoll starts polling.
+	autoPoll := AutoPoll
+	c.Assert(client.Reconfigure(context.Background(), ReconfigureOptions{PollingMode: &autoPoll}), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	waitFor(t, func() bool {
+		return client.GetStringValue("key", "", nil) == "value2"
+	})
+
+	// Switching back to Manual stops it.
+	manual := Manual
+	c.Assert(client.Reconfigure(context.Background(), ReconfigureOptions{PollingMode: &manual}), qt.IsNil)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value3"))
+	n := len(srv.allResponses())
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(srv.allResponses(), qt.HasLen, n)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2")
+}
+
+func TestClient_Reconfigure_BaseURL(t *testing.T) {
+	c := qt.New(t)
+	srv1 := newConfigServer(t)
+	srv1.setResponseJSON(rootNodeWithKeyValue("key", "value1"))
+	srv2 := newConfigServerWithKey(t, srv1.key)
+	srv2.setResponseJSON(rootNodeWithKeyValue("key", "value2"))
+	cfg := srv1.config()
+	cfg.PollingMode = Manual
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	c.Assert(client.Reconfigure(context.Background(), ReconfigureOptions{BaseURLs: []string{srv2.srv.URL}}), qt.IsNil)
+	c.Assert(client.Stats().BaseURL, qt.Equals, srv2.srv.URL)
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2")
+	c.Assert(srv1.allResponses(), qt.HasLen, 1)
+	c.Assert(srv2.allResponses(), qt.HasLen, 1)
+
+	// The configuration for a new key is fetched from the new base URL.
+	srv3 := newConfigServer(t)
+	srv3.setResponseJSON(rootNodeWithKeyValue("key", "value3"))
+	c.Assert(client.Reconfigure(context.Background(), ReconfigureOptions{SDKKey: srv3.key, BaseURL: srv3.srv.URL}), qt.IsNil)
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value3")
+	c.Assert(client.Stats().BaseURL, qt.Equals, srv3.srv.URL)
+	c.Assert(srv2.allResponses(), qt.HasLen, 1)
+}
+
+func TestClient_Reconfigure_SharedFetcher(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.ShareFetcher = true
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	err := client.Reconfigure(context.Background(), ReconfigureOptions{PollInterval: time.Second})
+	c.Assert(err, qt.ErrorMatches, `cannot reconfigure a client that shares its fetcher or has an invalid SDK key`)
+}
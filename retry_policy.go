@@ -0,0 +1,138 @@
+package configcat
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultRetryMaxAttempts holds the default value of RetryPolicy.MaxAttempts.
+	DefaultRetryMaxAttempts = 3
+
+	// DefaultRetryInitialBackoff holds the default value of RetryPolicy.InitialBackoff.
+	DefaultRetryInitialBackoff = 500 * time.Millisecond
+
+	// DefaultRetryMaxBackoff holds the default value of RetryPolicy.MaxBackoff.
+	DefaultRetryMaxBackoff = 10 * time.Second
+)
+
+// defaultRetryPolicy is used when Config.RetryPolicy is nil.
+var defaultRetryPolicy = &RetryPolicy{}
+
+// RetryPolicy describes how failed config fetches are retried
+// within a single refresh.
+//
+// Only transient failures are retried: timeouts, network errors,
+// HTTP 429 (Too Many Requests) and 5xx responses. An invalid SDK key
+// or an invalid config JSON response fails immediately.
+type RetryPolicy struct {
+	// MaxAttempts holds the maximum number of fetch attempts
+	// per refresh, including the first one. If it's less
+	// than 1, DefaultRetryMaxAttempts is used. Set it to
+	// 1 to disable retries.
+	MaxAttempts int
+
+	// InitialBackoff holds the upper bound of the delay before
+	// the first retry. The bound doubles for each subsequent
+	// retry and the actual delay is chosen randomly between zero
+	// and the bound ("full jitter"), so that many clients failing
+	// at the same moment don't all retry at the same moment.
+	// If it's less than 1, DefaultRetryInitialBackoff is used.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the delay between two attempts.
+	// If it's less than 1, DefaultRetryMaxBackoff is used.
+	//
+	// When the server responds with a Retry-After header
+	// asking for a longer delay than this, the refresh
+	// fails without any further attempt.
+	MaxBackoff time.Duration
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return DefaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) initialBackoff() time.Duration {
+	if p.InitialBackoff < 1 {
+		return DefaultRetryInitialBackoff
+	}
+	return p.InitialBackoff
+}
+
+func (p *RetryPolicy) maxBackoff() time.Duration {
+	if p.MaxBackoff < 1 {
+		return DefaultRetryMaxBackoff
+	}
+	return p.MaxBackoff
+}
+
+// delay returns how long to wait before the given retry
+// (starting at 1) after a fetch failed with err. It reports
+// false if the fetch shouldn't be retried at all.
+func (p *RetryPolicy) delay(retry int, err error) (time.Duration, bool) {
+	var fErr *fetcherError
+	if !errors.As(err, &fErr) || !fErr.isTransient() {
+		return 0, false
+	}
+	if fErr.retryAfter > 0 {
+		if fErr.retryAfter > p.maxBackoff() {
+			return 0, false
+		}
+		return fErr.retryAfter, true
+	}
+	bound := p.maxBackoff()
+	if shift := retry - 1; shift < 32 {
+		if b := p.initialBackoff() << shift; b > 0 && b < bound {
+			bound = b
+		}
+	}
+	return time.Duration(rand.Int63n(int64(bound) + 1)), true
+}
+
+// retryAfter returns the delay that the server asked for through
+// the Retry-After header of the response that caused err, if any.
+func retryAfter(err error) time.Duration {
+	var fErr *fetcherError
+	if errors.As(err, &fErr) {
+		return fErr.retryAfter
+	}
+	return 0
+}
+
+// isTransient reports whether the fetch that failed
+// with f has a chance of succeeding if it's tried again.
+func (f *fetcherError) isTransient() bool {
+	switch f.EventId {
+	case 1102, 1103:
+		return true
+	case 1101:
+		return f.statusCode == http.StatusTooManyRequests || f.statusCode >= 500
+	}
+	return false
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which
+// holds either a number of seconds or an HTTP date. It returns
+// zero if the header is absent or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,174 @@
+package configcat
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestRetryPolicy_TransientFailure(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.queueResponses(
+		configResponse{status: http.StatusBadGateway, body: `bad gateway`},
+		configResponse{status: http.StatusInternalServerError, body: `something failed`},
+	)
+	srv.setResponse(configResponse{body: `{"test":1}`})
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.RetryPolicy = &RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	err := client.Refresh(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.fetcher.current().body(), qt.Equals, `{"test":1}`)
+	c.Assert(srv.allResponses(), qt.HasLen, 3)
+}
+
+func TestRetryPolicy_Default(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.queueResponses(configResponse{status: http.StatusBadGateway, body: `bad gateway`})
+	srv.setResponse(configResponse{body: `{"test":1}`})
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	err := client.Refresh(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 2)
+}
+
+func TestRetryPolicy_MaxAttempts(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{status: http.StatusInternalServerError, body: `something failed`})
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.RetryPolicy = &RetryPolicy{
+		MaxAttempts:    2,
+		InitialBackoff: time.Millisecond,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	err := client.Refresh(context.Background())
+	c.Assert(err, qt.ErrorMatches, `config fetch failed: unexpected HTTP response was received while trying to fetch config JSON: 500 Internal Server Error`)
+	c.Assert(srv.allResponses(), qt.HasLen, 2)
+}
+
+func TestRetryPolicy_NoRetryOnInvalidSDKKey(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{status: http.StatusNotFound, body: `not found`})
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.RetryPolicy = &RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	err := client.Refresh(context.Background())
+	c.Assert(err, qt.ErrorMatches, `config fetch failed: your SDK Key seems to be wrong.*`)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+}
+
+func TestRetryPolicy_RetryAfter(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.queueResponses(configResponse{
+		status: http.StatusTooManyRequests,
+		body:   `slow down`,
+		header: http.Header{"Retry-After": {"1"}},
+	})
+	srv.setResponse(configResponse{body: `{"test":1}`})
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.RetryPolicy = &RetryPolicy{
+		InitialBackoff: time.Millisecond,
+	}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	t0 := time.Now()
+	err := client.Refresh(context.Background())
+	c.Assert(err, qt.IsNil)
+	c.Assert(time.Since(t0) >= time.Second, qt.IsTrue)
+	c.Assert(client.fetcher.current().body(), qt.Equals, `{"test":1}`)
+}
+
+func TestRetryPolicy_RetryAfterTooLong(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{
+		status: http.StatusServiceUnavailable,
+		body:   `unavailable`,
+		header: http.Header{"Retry-After": {"3600"}},
+	})
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	cfg.LogLevel = LogLevelNone
+	cfg.RetryPolicy = &RetryPolicy{}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	err := client.Refresh(context.Background())
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+}
+
+func TestRetryPolicy_PollerRetryAfter(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	tooMany := configResponse{
+		status: http.StatusTooManyRequests,
+		body:   `slow down`,
+		header: http.Header{"Retry-After": {"1"}},
+	}
+	srv.queueResponses(tooMany, tooMany)
+	srv.setResponse(configResponse{body: `{"test":1}`})
+	cfg := srv.config()
+	cfg.PollInterval = 10 * time.Millisecond
+	cfg.LogLevel = LogLevelNone
+	cfg.RetryPolicy = &RetryPolicy{MaxAttempts: 1}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+
+	// The poller doesn't poll again until the requested delay has passed.
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(srv.allResponses(), qt.HasLen, 2)
+	waitFor(t, func() bool {
+		return client.fetcher.current().body() == `{"test":1}`
+	})
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	c := qt.New(t)
+	p := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	transient := &fetcherError{EventId: 1103}
+	for i := 0; i < 100; i++ {
+		d, ok := p.delay(1, transient)
+		c.Assert(ok, qt.IsTrue)
+		c.Assert(d <= 100*time.Millisecond, qt.IsTrue)
+		d, _ = p.delay(10, transient)
+		c.Assert(d <= 300*time.Millisecond, qt.IsTrue)
+	}
+	_, ok := p.delay(1, &fetcherError{EventId: 1105})
+	c.Assert(ok, qt.IsFalse)
+	c.Assert(parseRetryAfter("5", time.Now()), qt.Equals, 5*time.Second)
+	c.Assert(parseRetryAfter("junk", time.Now()), qt.Equals, time.Duration(0))
+	now := time.Now()
+	c.Assert(parseRetryAfter(now.Add(time.Minute).UTC().Format(http.TimeFormat), now) > 58*time.Second, qt.IsTrue)
+}
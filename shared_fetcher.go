@@ -0,0 +1,342 @@
+package configcat
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sharedFetchers holds the fetchers shared between clients
+// created with Config.ShareFetcher.
+var sharedFetchers = struct {
+	mu sync.Mutex
+	m  map[sharedFetcherKey]*sharedFetcher
+}{
+	m: make(map[sharedFetcherKey]*sharedFetcher),
+}
+
+// sharedFetcherKey identifies the clients that can share a fetcher:
+// those whose configurations only differ by per-client parameters.
+type sharedFetcherKey struct {
+	sdkKey         string
+	baseURLs       string
+	dataGovernance DataGovernance
+	overrides      *FlagOverrides
+	source         ConfigSource
+	autoOffline    *AutoOfflinePolicy
+	checksummed    bool
+	cache          ConfigCache
+	cacheTTL       time.Duration
+	transport      http.RoundTripper
+	httpTimeout    time.Duration
+	retryPolicy    *RetryPolicy
+	pollingMode    PollingMode
+	pollInterval   time.Duration
+	startFromCache bool
+	offline        bool
+}
+
+// sharedFetcher is a configFetcher shared by several clients.
+// It fans OnConfigChanged, OnConfigChangedWithDiff, OnBeforeConfigApply, OnStateChange and
+// OnError out to the hooks of all the clients using it, and its log
+// messages out to their loggers.
+type sharedFetcher struct {
+	key   sharedFetcherKey
+	hooks *Hooks
+
+	// fetcher is created by the first client to get
+	// through initOnce, without sharedFetchers.mu held.
+	fetcher  *configFetcher
+	initOnce sync.Once
+
+	// refs holds the references of the clients using the
+	// fetcher. It is guarded by sharedFetchers.mu.
+	refs map[*sharedFetcherRef]struct{}
+
+	// subscribers holds a copy of refs that's replaced
+	// whenever refs changes, so that hooks and loggers
+	// can be called without holding any lock.
+	subscribers atomic.Value // holds []*sharedFetcherRef
+}
+
+// acquireSharedFetcher returns a reference to the shared fetcher
+// for cfg, creating it if there isn't one yet. It reports false
+// if cfg doesn't ask for a shared fetcher or can't use one.
+func acquireSharedFetcher(cfg Config, logger *leveledLogger) (*sharedFetcherRef, bool) {
+	if !cfg.ShareFetcher || !isComparable(cfg.Source) || !isComparable(cfg.Cache) || !isComparable(cfg.Transport) {
+		return nil, false
+	}
+	key := sharedFetcherKey{
+		sdkKey:         cfg.SDKKey,
+		baseURLs:       cfg.BaseURL,
+		dataGovernance: cfg.DataGovernance,
+		overrides:      cfg.FlagOverrides,
+		source:         cfg.Source,
+		autoOffline:    cfg.AutoOffline,
+		checksummed:    cfg.ChecksummedCacheFormat,
+		cache:          cfg.Cache,
+		cacheTTL:       cfg.CacheTTL,
+		transport:      cfg.Transport,
+		httpTimeout:    cfg.HTTPTimeout,
+		retryPolicy:    cfg.RetryPolicy,
+		pollingMode:    cfg.PollingMode,
+		pollInterval:   cfg.PollInterval,
+		startFromCache: cfg.StartFromCache,
+		offline:        cfg.Offline,
+	}
+	if len(cfg.BaseURLs) > 0 {
+		key.baseURLs = strings.Join(cfg.BaseURLs, " ")
+	}
+	ref := &sharedFetcherRef{
+		logger:      logger,
+		defaultUser: cfg.DefaultUser,
+		hooks:       cfg.Hooks,
+	}
+	sharedFetchers.mu.Lock()
+	sf := sharedFetchers.m[key]
+	if sf == nil {
+		sf = &sharedFetcher{
+			key:  key,
+			refs: make(map[*sharedFetcherRef]struct{}),
+		}
+		sf.hooks = &Hooks{
+			OnConfigChangedWithDiff: sf.configChanged,
+			OnError:                 sf.error,
+			OnBeforeConfigApply:     sf.beforeConfigApply,
+			OnStateChange:           sf.stateChange,
+			// Each client delivers the calls through its own dispatcher.
+			dispatcher: &hookDispatcher{inline: true},
+		}
+		sharedFetchers.m[key] = sf
+	}
+	ref.sharedFetcher = sf
+	sf.refs[ref] = struct{}{}
+	sf.updateSubscribers()
+	sharedFetchers.mu.Unlock()
+
+	// Creating the fetcher may read the cache, so it's done without
+	// the global lock held; the other clients wait for it here.
+	sf.initOnce.Do(func() {
+		// The per-client parameters are applied by each
+		// sharedFetcherRef rather than by the fetcher itself.
+		fcfg := cfg
+		fcfg.Hooks = sf.hooks
+		fcfg.DefaultUser = nil
+		// Each client's logger decides whether to log each message.
+		sf.fetcher = newConfigFetcher(fcfg, newLeveledLogger(sharedLogger{sf}, LogLevelDebug, sf.hooks), nil).(*configFetcher)
+	})
+	return ref, true
+}
+
+// isComparable reports whether v can be used in a sharedFetcherKey.
+func isComparable(v interface{}) bool {
+	return v == nil || reflect.TypeOf(v).Comparable()
+}
+
+// updateSubscribers must be called with sharedFetchers.mu held.
+func (sf *sharedFetcher) updateSubscribers() {
+	subscribers := make([]*sharedFetcherRef, 0, len(sf.refs))
+	for ref := range sf.refs {
+		subscribers = append(subscribers, ref)
+	}
+	sf.subscribers.Store(subscribers)
+}
+
+func (sf *sharedFetcher) clients() []*sharedFetcherRef {
+	return sf.subscribers.Load().([]*sharedFetcherRef)
+}
+
+func (sf *sharedFetcher) configChanged(change *ConfigChange) {
+	for _, ref := range sf.clients() {
+		hooks := ref.hooks
+		if hooks == nil {
+			continue
+		}
+		hooks.watchers.notify()
+		if hooks.OnConfigChanged != nil {
+			hooks.dispatch(hooks.OnConfigChanged)
+		}
+		if hooks.OnConfigChangedWithDiff != nil {
+			hooks.dispatch(func() {
+				hooks.OnConfigChangedWithDiff(change)
+			})
+		}
+	}
+}
+
+// beforeConfigApply rejects the new configuration
+// if any of the clients rejects it.
+func (sf *sharedFetcher) beforeConfigApply(old, new *ConfigJson) error {
+	for _, ref := range sf.clients() {
+		if hooks := ref.hooks; hooks != nil && hooks.OnBeforeConfigApply != nil {
+			if err := hooks.OnBeforeConfigApply(old, new); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sf *sharedFetcher) stateChange(offline bool) {
+	for _, ref := range sf.clients() {
+		if hooks := ref.hooks; hooks != nil && hooks.OnStateChange != nil {
+			hooks.dispatch(func() {
+				hooks.OnStateChange(offline)
+			})
+		}
+	}
+}
+
+func (sf *sharedFetcher) error(err error) {
+	for _, ref := range sf.clients() {
+		if hooks := ref.hooks; hooks != nil && hooks.OnError != nil {
+			hooks.dispatch(func() {
+				hooks.OnError(err)
+			})
+		}
+	}
+}
+
+// sharedLogger is the Logger of a shared fetcher. It passes each
+// message on to the loggers of the clients using the fetcher
+// whose log level enables it.
+type sharedLogger struct {
+	sf *sharedFetcher
+}
+
+func (l sharedLogger) Debugf(format string, args ...interface{}) {
+	for _, ref := range l.sf.clients() {
+		if ref.logger.enabled(LogLevelDebug) {
+			ref.logger.Logger.Debugf(format, args...)
+		}
+	}
+}
+
+func (l sharedLogger) Infof(format string, args ...interface{}) {
+	for _, ref := range l.sf.clients() {
+		if ref.logger.enabled(LogLevelInfo) {
+			ref.logger.Logger.Infof(format, args...)
+		}
+	}
+}
+
+func (l sharedLogger) Warnf(format string, args ...interface{}) {
+	for _, ref := range l.sf.clients() {
+		if ref.logger.enabled(LogLevelWarn) {
+			ref.logger.Logger.Warnf(format, args...)
+		}
+	}
+}
+
+func (l sharedLogger) Errorf(format string, args ...interface{}) {
+	for _, ref := range l.sf.clients() {
+		if ref.logger.enabled(LogLevelError) {
+			ref.logger.Logger.Errorf(format, args...)
+		}
+	}
+}
+
+// sharedFetcherRef is the fetcher used by a single client
+// of a shared fetcher.
+type sharedFetcherRef struct {
+	*sharedFetcher
+	logger      *leveledLogger
+	defaultUser User
+	hooks       *Hooks
+	closeOnce   sync.Once
+
+	// defaultUserSnapshot holds the snapshot for the client's
+	// default user and the most recently seen configuration.
+	defaultUserSnapshot atomic.Value // holds *Snapshot
+}
+
+var _ fetcher = (*sharedFetcherRef)(nil)
+
+func (ref *sharedFetcherRef) refreshIfOlder(ctx context.Context, before time.Time, wait bool) error {
+	return ref.fetcher.refreshIfOlder(ctx, before, wait)
+}
+
+func (ref *sharedFetcherRef) current() *config {
+	return ref.fetcher.current()
+}
+
+func (ref *sharedFetcherRef) isOffline() bool {
+	return ref.fetcher.isOffline()
+}
+
+func (ref *sharedFetcherRef) isStreaming() bool {
+	return ref.fetcher.isStreaming()
+}
+
+func (ref *sharedFetcherRef) setMode(offline bool) {
+	ref.fetcher.setMode(offline)
+}
+
+func (ref *sharedFetcherRef) requestProbe() bool {
+	return ref.fetcher.requestProbe()
+}
+
+func (ref *sharedFetcherRef) context() context.Context {
+	return ref.fetcher.context()
+}
+
+func (ref *sharedFetcherRef) doneInitGet() chan struct{} {
+	return ref.fetcher.doneInitGet()
+}
+
+func (ref *sharedFetcherRef) stats() ClientStats {
+	return ref.fetcher.stats()
+}
+
+// close releases the reference to the shared fetcher,
+// closing the fetcher when it's the last one.
+func (ref *sharedFetcherRef) close() {
+	if ref.release() {
+		ref.fetcher.close()
+	}
+}
+
+// shutdown is like close except that it shuts the
+// fetcher down gracefully when it's the last reference.
+func (ref *sharedFetcherRef) shutdown(ctx context.Context) error {
+	if ref.release() {
+		return ref.fetcher.shutdown(ctx)
+	}
+	return nil
+}
+
+// release releases the reference to the shared fetcher and
+// reports whether it was the last one, in which case the
+// caller is responsible for closing the fetcher.
+func (ref *sharedFetcherRef) release() (last bool) {
+	ref.closeOnce.Do(func() {
+		sharedFetchers.mu.Lock()
+		defer sharedFetchers.mu.Unlock()
+		sf := ref.sharedFetcher
+		delete(sf.refs, ref)
+		sf.updateSubscribers()
+		last = len(sf.refs) == 0
+		if last {
+			delete(sharedFetchers.m, sf.key)
+		}
+	})
+	return last
+}
+
+// snapshot is like newSnapshot except that it applies
+// the client's own default user and hooks.
+func (ref *sharedFetcherRef) snapshot(cfg *config, user User) *Snapshot {
+	if cfg != nil && (user == nil || user == ref.defaultUser) {
+		if snap, _ := ref.defaultUserSnapshot.Load().(*Snapshot); snap != nil && snap.config == cfg {
+			return snap
+		}
+		snap := _newSnapshot(cfg, ref.defaultUser, ref.logger, ref.hooks)
+		ref.defaultUserSnapshot.Store(snap)
+		return snap
+	}
+	return _newSnapshot(cfg, user, ref.logger, ref.hooks)
+}
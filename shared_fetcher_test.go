@@ -0,0 +1,211 @@
+package configcat
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSharedFetcher(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(&ConfigJson{
+		Settings: map[string]*Setting{
+			"key": {
+				Value: &SettingValue{Value: "default"},
+				TargetingRules: []*TargetingRule{{
+					Conditions: []*Condition{{
+						UserCondition: &UserCondition{
+							Comparator:          OpOneOf,
+							ComparisonAttribute: "Identifier",
+							StringArrayValue:    []string{"bob"},
+						},
+					}},
+					ServedValue: &ServedValue{
+						Value: &SettingValue{Value: "bob-value"},
+					},
+				}},
+			},
+		},
+	})
+	changed1 := make(chan struct{}, 1)
+	changed2 := make(chan struct{}, 1)
+
+	cfg1 := srv.config()
+	cfg1.PollingMode = Manual
+	cfg1.ShareFetcher = true
+	cfg1.Hooks = &Hooks{OnConfigChanged: func() { changed1 <- struct{}{} }}
+	client1 := NewCustomClient(cfg1)
+	defer client1.Close()
+
+	cfg2 := cfg1
+	cfg2.DefaultUser = &UserData{Identifier: "bob"}
+	cfg2.Hooks = &Hooks{OnConfigChanged: func() { changed2 <- struct{}{} }}
+	client2 := NewCustomClient(cfg2)
+	defer client2.Close()
+
+	c.Assert(client1.fetcher.(*sharedFetcherRef).fetcher, qt.Equals, client2.fetcher.(*sharedFetcherRef).fetcher)
+
+	c.Assert(client1.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 1)
+	for _, ch := range []chan struct{}{changed1, changed2} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for notification")
+		}
+	}
+
+	// Each client applies its own default user.
+	c.Assert(client1.GetStringValue("key", "", nil), qt.Equals, "default")
+	c.Assert(client2.GetStringValue("key", "", nil), qt.Equals, "bob-value")
+	c.Assert(client2.GetStringValue("key", "", &UserData{Identifier: "alice"}), qt.Equals, "default")
+
+	// Closing one client leaves the fetcher running for the other.
+	client1.Close()
+	c.Assert(client2.Refresh(context.Background()), qt.IsNil)
+	c.Assert(srv.allResponses(), qt.HasLen, 2)
+
+	client2.Close()
+	sharedFetchers.mu.Lock()
+	defer sharedFetchers.mu.Unlock()
+	c.Assert(sharedFetchers.m, qt.HasLen, 0)
+}
+
+func TestSharedFetcher_DifferentKeys(t *testing.T) {
+	c := qt.New(t)
+	srv1 := newConfigServer(t)
+	srv2 := newConfigServer(t)
+	cfg1 := srv1.config()
+	cfg1.PollingMode = Manual
+	cfg1.ShareFetcher = true
+	client1 := NewCustomClient(cfg1)
+	defer client1.Close()
+	cfg2 := srv2.config()
+	cfg2.PollingMode = Manual
+	cfg2.ShareFetcher = true
+	client2 := NewCustomClient(cfg2)
+	defer client2.Close()
+	c.Assert(client1.fetcher.(*sharedFetcherRef).fetcher, qt.Not(qt.Equals), client2.fetcher.(*sharedFetcherRef).fetcher)
+
+	// Without ShareFetcher, the client has its own fetcher.
+	cfg3 := srv1.config()
+	cfg3.PollingMode = Manual
+	client3 := NewCustomClient(cfg3)
+	defer client3.Close()
+	_, ok := client3.fetcher.(*configFetcher)
+	c.Assert(ok, qt.IsTrue)
+}
+
+func TestSharedFetcher_DifferentSettings(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	cfg1 := srv.config()
+	cfg1.PollingMode = Manual
+	cfg1.ShareFetcher = true
+	client1 := NewCustomClient(cfg1)
+	defer client1.Close()
+	cfg2 := cfg1
+	cfg2.HTTPTimeout = time.Minute
+	client2 := NewCustomClient(cfg2)
+	defer client2.Close()
+	c.Assert(client1.fetcher.(*sharedFetcherRef).fetcher, qt.Not(qt.Equals), client2.fetcher.(*sharedFetcherRef).fetcher)
+
+	// StartFromCache and Offline are applied by the
+	// shared fetcher, so they must match too.
+	cfg3 := cfg1
+	cfg3.Offline = true
+	client3 := NewCustomClient(cfg3)
+	defer client3.Close()
+	c.Assert(client3.fetcher.(*sharedFetcherRef).fetcher, qt.Not(qt.Equals), client1.fetcher.(*sharedFetcherRef).fetcher)
+	c.Assert(client3.IsOffline(), qt.IsTrue)
+	cfg4 := cfg1
+	cfg4.StartFromCache = true
+	client4 := NewCustomClient(cfg4)
+	defer client4.Close()
+	c.Assert(client4.fetcher.(*sharedFetcherRef).fetcher, qt.Not(qt.Equals), client1.fetcher.(*sharedFetcherRef).fetcher)
+}
+
+func TestSharedFetcher_CreatedWithoutGlobalLock(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{body: `{"test":1}`})
+	cache := &gatedCache{
+		release: make(chan struct{}),
+	}
+	cfg1 := srv.config()
+	cfg1.PollInterval = time.Minute
+	cfg1.StartFromCache = true
+	cfg1.Cache = cache
+	cfg1.ShareFetcher = true
+
+	// The first client blocks while its fetcher reads the cache.
+	created1 := make(chan *Client, 1)
+	go func() {
+		created1 <- NewCustomClient(cfg1)
+	}()
+	waitFor(t, func() bool {
+		sharedFetchers.mu.Lock()
+		defer sharedFetchers.mu.Unlock()
+		for key := range sharedFetchers.m {
+			if key.cache == cache {
+				return true
+			}
+		}
+		return false
+	})
+
+	// Clients with other parameters aren't held up meanwhile...
+	cfg2 := srv.config()
+	cfg2.PollingMode = Manual
+	cfg2.ShareFetcher = true
+	client2 := NewCustomClient(cfg2)
+	defer client2.Close()
+
+	// ...and those that share the fetcher wait for it.
+	created3 := make(chan *Client, 1)
+	go func() {
+		created3 <- NewCustomClient(cfg1)
+	}()
+	select {
+	case <-created3:
+		t.Fatalf("client created before the shared fetcher")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(cache.release)
+	client1 := <-created1
+	defer client1.Close()
+	client3 := <-created3
+	defer client3.Close()
+	c.Assert(client3.fetcher.(*sharedFetcherRef).fetcher, qt.Equals, client1.fetcher.(*sharedFetcherRef).fetcher)
+}
+
+func TestSharedFetcher_Loggers(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{status: http.StatusNotFound, body: `not found`})
+	logger1 := newTestLogger(t).(*testLogger)
+	logger2 := newTestLogger(t).(*testLogger)
+	cfg1 := srv.config()
+	cfg1.PollingMode = Manual
+	cfg1.ShareFetcher = true
+	cfg1.Logger = logger1
+	cfg1.LogLevel = LogLevelError
+	client1 := NewCustomClient(cfg1)
+	defer client1.Close()
+	cfg2 := cfg1
+	cfg2.Logger = logger2
+	cfg2.LogLevel = LogLevelNone
+	client2 := NewCustomClient(cfg2)
+	defer client2.Close()
+	c.Assert(client1.fetcher.(*sharedFetcherRef).fetcher, qt.Equals, client2.fetcher.(*sharedFetcherRef).fetcher)
+
+	c.Assert(client2.Refresh(context.Background()), qt.Not(qt.IsNil))
+	c.Assert(logger1.Logs(), qt.DeepEquals, []string{
+		"ERROR: [1100] config fetch failed: your SDK Key seems to be wrong; you can find the valid SDK Key at https://app.configcat.com/sdkkey",
+	})
+	c.Assert(logger2.Logs(), qt.HasLen, 0)
+}
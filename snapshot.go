@@ -28,6 +28,11 @@ func (e ErrKeyNotFound) Error() string {
 	)
 }
 
+// ErrConfigTooStale is reported in EvaluationDetailsData.Error
+// when the configuration is older than Config.MaxConfigAge.
+// EvaluationDetailsData.FetchTime holds when it was fetched.
+var ErrConfigTooStale = errors.New("the configuration is too old to be used")
+
 // Snapshot holds a snapshot of the ConfigCat configuration.
 // A snapshot is immutable once taken.
 //
@@ -63,6 +68,10 @@ type Snapshot struct {
 
 	// evaluators maps keyID to the evaluator for that key.
 	evaluators []settingEvalFunc
+
+	// err, when non-nil, is returned for every evaluation
+	// instead of using the configuration.
+	err error
 }
 
 // NewSnapshot returns a snapshot that always returns the given values.
@@ -156,11 +165,24 @@ func _newSnapshot(cfg *config, user User, logger *leveledLogger, hooks *Hooks) *
 	return snap
 }
 
+// newErrorSnapshot returns a snapshot that fails every evaluation with
+// err, although it still reports the fetch time of cfg.
+func newErrorSnapshot(cfg *config, err error, user User, logger *leveledLogger, hooks *Hooks) *Snapshot {
+	return &Snapshot{
+		config:       cfg,
+		user:         reflect.ValueOf(user),
+		logger:       logger,
+		originalUser: user,
+		hooks:        hooks,
+		err:          err,
+	}
+}
+
 // WithUser returns a copy of s associated with the
 // given user. If snap is nil, it returns nil.
 // If user is nil, it uses Config.DefaultUser.
 func (snap *Snapshot) WithUser(user User) *Snapshot {
-	if snap == nil || snap.config == nil {
+	if snap == nil || snap.config == nil || snap.err != nil {
 		// Note: when there's no config, we know there are no
 		// rules that can change the values returned, so no
 		// need to do anything.
@@ -224,6 +246,23 @@ func (snap *Snapshot) details(id keyID, key string) (interface{}, string, *Targe
 	if snap == nil {
 		return nil, "", nil, nil, errors.New("snapshot is nil")
 	}
+	if snap.err != nil {
+		if hooks := snap.hooks; hooks != nil && hooks.OnFlagEvaluated != nil {
+			details := &EvaluationDetails{
+				Data: EvaluationDetailsData{
+					Key:            key,
+					User:           snap.originalUser,
+					IsDefaultValue: true,
+					Error:          snap.err,
+					FetchTime:      snap.FetchTime(),
+				},
+			}
+			hooks.dispatchEvaluation(func() {
+				hooks.OnFlagEvaluated(details)
+			})
+		}
+		return nil, "", nil, nil, snap.err
+	}
 	var eval settingEvalFunc
 	if int(id) < len(snap.evaluators) {
 		eval = snap.evaluators[id]
@@ -252,7 +291,8 @@ func (snap *Snapshot) details(id keyID, key string) (interface{}, string, *Targe
 		atomic.StoreInt32(&snap.cache[cacheIndex], valID)
 	}
 	if snap.hooks != nil && snap.hooks.OnFlagEvaluated != nil {
-		go snap.hooks.OnFlagEvaluated(&EvaluationDetails{
+		hooks := snap.hooks
+		details := &EvaluationDetails{
 			Value: val,
 			Data: EvaluationDetailsData{
 				Key:                     key,
@@ -262,6 +302,9 @@ func (snap *Snapshot) details(id keyID, key string) (interface{}, string, *Targe
 				MatchedTargetingRule:    targeting,
 				MatchedPercentageOption: percentage,
 			},
+		}
+		hooks.dispatchEvaluation(func() {
+			hooks.OnFlagEvaluated(details)
 		})
 	}
 	return val, varID, targeting, percentage, nil
@@ -334,7 +377,7 @@ func (snap *Snapshot) GetAllValueDetails() []EvaluationDetails {
 // are associated with the given variation ID. If the
 // variation ID isn't found, it returns "", nil.
 func (snap *Snapshot) GetKeyValueForVariationID(id string) (string, interface{}) {
-	if snap == nil {
+	if snap == nil || snap.err != nil {
 		return "", nil
 	}
 	key, value := snap.config.getKeyAndValueForVariation(id)
@@ -0,0 +1,173 @@
+package configcat
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ConfigOrigin describes where the configuration
+// currently used by a client came from.
+type ConfigOrigin int
+
+const (
+	// ConfigOriginNone means that the client has no configuration.
+	ConfigOriginNone ConfigOrigin = iota
+
+	// ConfigOriginHTTP means that the configuration was fetched
+	// by the client, over HTTP or from Config.Source.
+	ConfigOriginHTTP
+
+	// ConfigOriginCache means that the configuration
+	// was read from Config.Cache.
+	ConfigOriginCache
+
+	// ConfigOriginOverrides means that the configuration comes from
+	// Config.FlagOverrides only (the overrides behavior is LocalOnly).
+	ConfigOriginOverrides
+)
+
+func (o ConfigOrigin) String() string {
+	switch o {
+	case ConfigOriginNone:
+		return "None"
+	case ConfigOriginHTTP:
+		return "HTTP"
+	case ConfigOriginCache:
+		return "Cache"
+	case ConfigOriginOverrides:
+		return "Overrides"
+	}
+	return "UNKNOWN"
+}
+
+// ClientStats holds statistics about the configuration fetches
+// made by a client. When clients share a fetcher (see Config.ShareFetcher),
+// the statistics cover the fetches made on behalf of all of them.
+type ClientStats struct {
+	// LastSuccessfulFetch holds when the configuration was last
+	// fetched successfully, or the zero time if it never was.
+	LastSuccessfulFetch time.Time
+
+	// ConfigFetchTime holds when the current configuration was
+	// fetched (possibly by another instance sharing the cache),
+	// or the zero time if there's no configuration.
+	ConfigFetchTime time.Time
+
+	// ConfigOrigin holds where the current configuration came from.
+	ConfigOrigin ConfigOrigin
+
+	// LastError holds the error of the most recent failed fetch, if any.
+	LastError error
+
+	// LastErrorEventId holds the event ID of LastError.
+	LastErrorEventId int
+
+	// ConsecutiveFailures holds the number of fetches that have
+	// failed since the last successful one.
+	ConsecutiveFailures int
+
+	// Fetches holds the total number of fetches, including
+	// failures but excluding canceled fetches. The retries,
+	// failovers and redirects made by a single refresh count
+	// as one fetch.
+	Fetches uint64
+
+	// ModifiedResponses holds how many of those fetches
+	// returned a new configuration (a 200 response).
+	ModifiedResponses uint64
+
+	// NotModifiedResponses holds how many of those fetches found
+	// that the configuration hadn't changed (a 304 response).
+	NotModifiedResponses uint64
+
+	// AverageFetchLatency holds the average duration of a
+	// fetch, including its retries, failovers and redirects.
+	AverageFetchLatency time.Duration
+
+	// BaseURL holds the base URL that the configuration is
+	// currently fetched from. It's empty when Config.Source is set.
+	BaseURL string
+
+	// DroppedHookCalls holds the number of OnFlagEvaluated calls
+	// that were dropped because the hook queue was full
+	// (see Config.HookOverflow).
+	DroppedHookCalls uint64
+}
+
+// Stats returns statistics about the configuration fetches
+// made by the client.
+func (client *Client) Stats() ClientStats {
+	stats := client.fetcher.stats()
+	stats.DroppedHookCalls = client.cfg.Hooks.dispatcher.droppedCalls()
+	return stats
+}
+
+// fetchStats accumulates the statistics of a configFetcher.
+type fetchStats struct {
+	mu                  sync.Mutex
+	lastSuccess         time.Time
+	lastError           error
+	lastErrorEventId    int
+	consecutiveFailures int
+	fetches             uint64
+	modified            uint64
+	notModified         uint64
+	totalLatency        time.Duration
+}
+
+// record records the result of a single fetch that started
+// at start, where prevConfig is the configuration passed to
+// the fetch and config and err are its results.
+func (s *fetchStats) record(start time.Time, prevConfig, config *config, err error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fetches++
+	s.totalLatency += now.Sub(start)
+	if err != nil {
+		s.lastError = err
+		s.lastErrorEventId = 0
+		var fErr *fetcherError
+		if errors.As(err, &fErr) {
+			s.lastErrorEventId = fErr.EventId
+		}
+		s.consecutiveFailures++
+		return
+	}
+	s.lastSuccess = now
+	s.consecutiveFailures = 0
+	// A configuration that hasn't changed shares
+	// its parsed content with the previous one.
+	if prevConfig != nil && config.root == prevConfig.root {
+		s.notModified++
+	} else {
+		s.modified++
+	}
+}
+
+// recordPush records a configuration pushed by the server
+// over the stream, which counts as a successful fetch without
+// contributing to the fetch counts and latency.
+func (s *fetchStats) recordPush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSuccess = time.Now()
+	s.consecutiveFailures = 0
+}
+
+// fill fills in the fields of stats held by s.
+func (s *fetchStats) fill(stats *ClientStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats.LastSuccessfulFetch = s.lastSuccess
+	stats.LastError = s.lastError
+	stats.LastErrorEventId = s.lastErrorEventId
+	stats.ConsecutiveFailures = s.consecutiveFailures
+	stats.Fetches = s.fetches
+	stats.ModifiedResponses = s.modified
+	stats.NotModifiedResponses = s.notModified
+	if s.fetches > 0 {
+		stats.AverageFetchLatency = s.totalLatency / time.Duration(s.fetches)
+	}
+}
@@ -0,0 +1,315 @@
+package configcat
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// streamServer is a stand-in for a server that pushes
+// config.json bodies over Server-Sent Events. Plain GET
+// requests are served with the most recently sent body.
+type streamServer struct {
+	srv *httptest.Server
+	key string
+
+	mu          sync.Mutex
+	body        string
+	events      chan string
+	connections int
+	polls       int
+	disconnect  chan struct{}
+
+	// noStream makes the server answer event stream
+	// requests like plain GET requests.
+	noStream bool
+}
+
+func newStreamServer(t testing.TB, body string) *streamServer {
+	srv := &streamServer{
+		key:        randomSdkKey(),
+		body:       body,
+		events:     make(chan string, 10),
+		disconnect: make(chan struct{}, 1),
+	}
+	srv.srv = httptest.NewServer(srv)
+	t.Cleanup(srv.srv.Close)
+	return srv
+}
+
+func (srv *streamServer) config(t testing.TB) Config {
+	return Config{
+		SDKKey:       srv.key,
+		BaseURL:      srv.srv.URL,
+		Logger:       newTestLogger(t),
+		LogLevel:     LogLevelError,
+		PollingMode:  Streaming,
+		PollInterval: time.Hour,
+	}
+}
+
+func (srv *streamServer) send(body string) {
+	srv.mu.Lock()
+	srv.body = body
+	srv.mu.Unlock()
+	srv.events <- body
+}
+
+func (srv *streamServer) counts() (connections, polls int) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.connections, srv.polls
+}
+
+func (srv *streamServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	srv.mu.Lock()
+	body := srv.body
+	if req.Header.Get("Accept") != "text/event-stream" {
+		srv.polls++
+		srv.mu.Unlock()
+		w.Write([]byte(body))
+		return
+	}
+	srv.connections++
+	noStream := srv.noStream
+	srv.mu.Unlock()
+	if noStream {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	for {
+		select {
+		case body := <-srv.events:
+			fmt.Fprintf(w, ": keep-alive\n\nid: %s\n", etagOf(body))
+			for _, line := range strings.Split(body, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprintf(w, "\n")
+			w.(http.Flusher).Flush()
+		case <-srv.disconnect:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func TestStreamingPolicy_PushedChange(t *testing.T) {
+	c := qt.New(t)
+	srv := newStreamServer(t, `{"f":{"key":{"t":1,"v":{"s":"value1"}}}}`)
+	client := NewCustomClient(srv.config(t))
+	defer client.Close()
+
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	srv.send("{\"f\":{\"key\":\n{\"t\":1,\"v\":{\"s\":\"value2\"}}}}")
+	waitFor(t, func() bool {
+		return client.GetStringValue("key", "", nil) == "value2"
+	})
+	// The event ID isn't an ETag.
+	c.Assert(client.fetcher.current().etag, qt.Equals, "")
+
+	_, polls := srv.counts()
+	c.Assert(polls, qt.Equals, 1)
+}
+
+func TestStreamingPolicy_WithNotify(t *testing.T) {
+	srv := newStreamServer(t, `{"test":1}`)
+	cfg := srv.config(t)
+	notifyc := make(chan struct{}, 1)
+	cfg.Hooks = &Hooks{OnConfigChanged: func() { notifyc <- struct{}{} }}
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	<-client.Ready()
+	<-notifyc
+
+	srv.send(`{"test":2}`)
+	select {
+	case <-notifyc:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for notification")
+	}
+}
+
+func TestStreamingPolicy_Reconnect(t *testing.T) {
+	c := qt.New(t)
+	srv := newStreamServer(t, `{"f":{"key":{"t":1,"v":{"s":"value1"}}}}`)
+	client := NewCustomClient(srv.config(t))
+	defer client.Close()
+	waitFor(t, func() bool {
+		connections, _ := srv.counts()
+		return connections == 1
+	})
+
+	srv.disconnect <- struct{}{}
+	waitFor(t, func() bool {
+		connections, _ := srv.counts()
+		return connections == 2
+	})
+	srv.send(`{"f":{"key":{"t":1,"v":{"s":"value2"}}}}`)
+	waitFor(t, func() bool {
+		return client.GetStringValue("key", "", nil) == "value2"
+	})
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2")
+}
+
+func TestStreamingPolicy_Redirect(t *testing.T) {
+	c := qt.New(t)
+	srv1 := newStreamServer(t, `{"f":{"key":{"t":1,"v":{"s":"value1"}}}}`)
+	srv2 := newStreamServer(t, `{"f":{"key":{"t":1,"v":{"s":"value2"}}}}`)
+	client := NewCustomClient(srv1.config(t))
+	defer client.Close()
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value1")
+
+	srv1.send(`{"p":{"u":"` + srv2.srv.URL + `","r":2},"f":{"key":{"t":1,"v":{"s":"value1"}}}}`)
+	waitFor(t, func() bool {
+		connections, _ := srv2.counts()
+		return connections == 1
+	})
+	c.Assert(client.GetStringValue("key", "", nil), qt.Equals, "value2")
+	c.Assert(client.Stats().BaseURL, qt.Equals, srv2.srv.URL)
+}
+
+func TestStreamingPolicy_FetchDoesNotOverwritePush(t *testing.T) {
+	c := qt.New(t)
+	transport := newBlockingTransport()
+	client := NewCustomClient(Config{
+		SDKKey:      randomSdkKey(),
+		PollingMode: Manual,
+		Logger:      newTestLogger(t),
+		LogLevel:    LogLevelError,
+		Transport:   transport,
+	})
+	defer client.Close()
+
+	// A config is pushed while a fetch of an older one is in progress.
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.Refresh(context.Background())
+	}()
+	<-transport.started
+	f := client.fetcher.(*configFetcher)
+	c.Assert(f.applyStreamed(context.Background(), []byte(`{"test":2}`), f.baseURL) == nil, qt.IsTrue)
+	transport.respond <- `{"test":1}`
+	c.Assert(<-errc, qt.IsNil)
+	c.Assert(client.fetcher.current().body(), qt.Equals, `{"test":2}`)
+}
+
+func TestStreamingPolicy_QuietStreamNotStale(t *testing.T) {
+	c := qt.New(t)
+	srv := newStreamServer(t, `{"f":{"key":{"t":1,"v":{"s":"value"}}}}`)
+	cfg := srv.config(t)
+	cfg.MaxConfigAge = 50 * time.Millisecond
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.GetStringValue("key", "default", nil), qt.Equals, "value")
+	waitFor(t, client.fetcher.isStreaming)
+
+	// No event is received, but the stream keeps the configuration up to date.
+	time.Sleep(3 * cfg.MaxConfigAge)
+	details := client.GetStringValueDetails("key", "default", nil)
+	c.Assert(details.Value, qt.Equals, "value")
+	c.Assert(details.Data.Error, qt.IsNil)
+
+	// Once the stream is disconnected, the age counts again.
+	srv.disconnect <- struct{}{}
+	waitFor(t, func() bool {
+		return client.GetStringValue("key", "default", nil) == "default"
+	})
+}
+
+func TestStreamingPolicy_QuietStreamUpToDate(t *testing.T) {
+	c := qt.New(t)
+	srv := newStreamServer(t, `{"f":{"key":{"t":1,"v":{"s":"value"}}}}`)
+	cfg := srv.config(t)
+	cfg.PollInterval = 20 * time.Millisecond
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, HasUpToDateFlagData)
+	waitFor(t, client.fetcher.isStreaming)
+
+	// No event is received, but the stream keeps the configuration up to date.
+	time.Sleep(5 * cfg.PollInterval)
+	c.Assert(client.WaitForReady(context.Background()), qt.Equals, HasUpToDateFlagData)
+	_, polls := srv.counts()
+	c.Assert(polls, qt.Equals, 1)
+}
+
+func TestStreamingPolicy_FallbackToPolling(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponse(configResponse{body: `{"test":1}`})
+	cfg := srv.config()
+	cfg.PollingMode = Streaming
+	cfg.PollInterval = 10 * time.Millisecond
+	cfg.LogLevel = LogLevelNone
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	<-client.Ready()
+	c.Assert(client.fetcher.current().body(), qt.Equals, `{"test":1}`)
+
+	// The config server doesn't support streaming,
+	// so changes are picked up by polling instead.
+	srv.setResponse(configResponse{body: `{"test":2}`})
+	waitFor(t, func() bool {
+		return client.fetcher.current().body() == `{"test":2}`
+	})
+}
+
+func TestStreamingPolicy_StreamingUnsupported(t *testing.T) {
+	c := qt.New(t)
+	srv := newStreamServer(t, `{"test":1}`)
+	srv.noStream = true
+	logger := newTestLogger(t).(*testLogger)
+	cfg := srv.config(t)
+	cfg.PollInterval = 10 * time.Millisecond
+	cfg.Logger = logger
+	cfg.LogLevel = LogLevelWarn
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	<-client.Ready()
+
+	// The server answered the stream request with a plain
+	// config.json, so the client keeps polling instead of
+	// trying to reconnect, which it would otherwise do
+	// within streamMinReconnectDelay.
+	srv.mu.Lock()
+	srv.body = `{"test":2}`
+	srv.mu.Unlock()
+	waitFor(t, func() bool {
+		return client.fetcher.current().body() == `{"test":2}`
+	})
+	time.Sleep(streamMinReconnectDelay + 200*time.Millisecond)
+	connections, polls := srv.counts()
+	c.Assert(connections, qt.Equals, 1)
+	c.Assert(polls > 10, qt.IsTrue)
+	var warnings []string
+	for _, log := range logger.Logs() {
+		if strings.Contains(log, "config stream unavailable") {
+			warnings = append(warnings, log)
+		}
+	}
+	c.Assert(warnings, qt.HasLen, 1)
+}
+
+func waitFor(t testing.TB, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,169 @@
+package configcat
+
+import (
+	"sync"
+)
+
+// Watch returns a channel that receives the evaluation details of
+// the given flag for the given user (or Config.DefaultUser if user is
+// nil) straight away and then whenever a configuration change makes
+// its value change.
+//
+// The channel has a buffer of one element. When the receiver falls
+// behind, intermediate values are dropped so that the next value received
+// is always the most recent one. The channel is closed when the returned
+// cancel function is called or the client is closed.
+func (client *Client) Watch(flag Flag, user User) (<-chan EvaluationDetails, func()) {
+	w := &flagWatcher{
+		flag: flag,
+		user: user,
+		ch:   make(chan EvaluationDetails, 1),
+	}
+	if !client.watchers.add(w) {
+		// The client has been closed.
+		close(w.ch)
+		return w.ch, func() {}
+	}
+	w.update(client)
+	return w.ch, func() {
+		client.watchers.remove(w)
+		w.close()
+	}
+}
+
+// flagWatchers holds the watchers registered with Client.Watch.
+type flagWatchers struct {
+	client *Client
+
+	mu       sync.Mutex
+	watchers map[*flagWatcher]bool
+	closed   bool
+
+	// updating is set while a goroutine updates the watchers,
+	// and again when they must be updated once more after that.
+	updating bool
+	again    bool
+}
+
+// notify updates the watchers, if any, after the configuration has
+// changed. The updates are made one at a time by a single goroutine,
+// so that evaluations, which can themselves dispatch hook calls, are
+// made outside the caller's goroutine and in order.
+func (ws *flagWatchers) notify() {
+	if ws == nil {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	switch {
+	case len(ws.watchers) == 0:
+	case ws.updating:
+		ws.again = true
+	default:
+		ws.updating = true
+		go ws.run()
+	}
+}
+
+func (ws *flagWatchers) run() {
+	for {
+		ws.update()
+		ws.mu.Lock()
+		if !ws.again {
+			ws.updating = false
+			ws.mu.Unlock()
+			return
+		}
+		ws.again = false
+		ws.mu.Unlock()
+	}
+}
+
+func (ws *flagWatchers) add(w *flagWatcher) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		return false
+	}
+	if ws.watchers == nil {
+		ws.watchers = make(map[*flagWatcher]bool)
+	}
+	ws.watchers[w] = true
+	return true
+}
+
+func (ws *flagWatchers) remove(w *flagWatcher) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	delete(ws.watchers, w)
+}
+
+func (ws *flagWatchers) update() {
+	ws.mu.Lock()
+	watchers := make([]*flagWatcher, 0, len(ws.watchers))
+	for w := range ws.watchers {
+		watchers = append(watchers, w)
+	}
+	ws.mu.Unlock()
+	for _, w := range watchers {
+		w.update(ws.client)
+	}
+}
+
+// close closes all the watchers and prevents new ones from being added.
+func (ws *flagWatchers) close() {
+	ws.mu.Lock()
+	watchers := ws.watchers
+	ws.watchers = nil
+	ws.closed = true
+	ws.mu.Unlock()
+	for w := range watchers {
+		w.close()
+	}
+}
+
+// flagWatcher watches a single flag on behalf of Client.Watch.
+type flagWatcher struct {
+	flag Flag
+	user User
+
+	// mu guards the fields below and serializes
+	// sends on ch with closing it.
+	mu     sync.Mutex
+	ch     chan EvaluationDetails
+	last   interface{}
+	sent   bool
+	closed bool
+}
+
+// update evaluates the flag and sends the result
+// if its value differs from the last one sent.
+func (w *flagWatcher) update(client *Client) {
+	// Evaluate with w.mu held so that a concurrent update
+	// can't send an older value after a more recent one.
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	details := w.flag.GetValueDetails(client.Snapshot(w.user))
+	if w.sent && details.Value == w.last {
+		return
+	}
+	w.last, w.sent = details.Value, true
+	// Replace any value that hasn't been received yet.
+	select {
+	case <-w.ch:
+	default:
+	}
+	w.ch <- details
+}
+
+func (w *flagWatcher) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.ch)
+	}
+}
@@ -0,0 +1,154 @@
+package configcat
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_Watch(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(&ConfigJson{
+		Settings: map[string]*Setting{
+			"batchSize": {Type: IntSetting, Value: &SettingValue{Value: 10}},
+			"other":     {Type: StringSetting, Value: &SettingValue{Value: "a"}},
+		},
+	})
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+
+	ch, cancel := client.Watch(Int("batchSize", 1), nil)
+	c.Assert(receiveDetails(t, ch).Value, qt.Equals, 10)
+
+	// A change to another flag doesn't send anything.
+	srv.setResponseJSON(&ConfigJson{
+		Settings: map[string]*Setting{
+			"batchSize": {Type: IntSetting, Value: &SettingValue{Value: 10}},
+			"other":     {Type: StringSetting, Value: &SettingValue{Value: "b"}},
+		},
+	})
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	assertNoDetails(t, ch)
+
+	srv.setResponseJSON(&ConfigJson{
+		Settings: map[string]*Setting{
+			"batchSize": {Type: IntSetting, Value: &SettingValue{Value: 20}},
+		},
+	})
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(receiveDetails(t, ch).Value, qt.Equals, 20)
+
+	cancel()
+	_, ok := <-ch
+	c.Assert(ok, qt.IsFalse)
+	cancel()
+}
+
+func TestClient_Watch_User(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("flag", false))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+
+	user := &UserData{Identifier: "bob"}
+	ch, cancel := client.Watch(Bool("flag", false), user)
+	defer cancel()
+	details := receiveDetails(t, ch)
+	c.Assert(details.Value, qt.Equals, false)
+	c.Assert(details.Data.User, qt.Equals, User(user))
+
+	srv.setResponseJSON(&ConfigJson{
+		Settings: map[string]*Setting{
+			"flag": {
+				Type:  BoolSetting,
+				Value: &SettingValue{Value: false},
+				TargetingRules: []*TargetingRule{{
+					Conditions: []*Condition{{
+						UserCondition: &UserCondition{
+							Comparator:          OpOneOf,
+							ComparisonAttribute: "Identifier",
+							StringArrayValue:    []string{"bob"},
+						},
+					}},
+					ServedValue: &ServedValue{Value: &SettingValue{Value: true}},
+				}},
+			},
+		},
+	})
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	c.Assert(receiveDetails(t, ch).Value, qt.Equals, true)
+}
+
+func TestClient_Watch_Close(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", "value"))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	client := NewCustomClient(cfg)
+	ch, cancel := client.Watch(String("key", ""), nil)
+	defer cancel()
+	c.Assert(receiveDetails(t, ch).Value, qt.Equals, "")
+	client.Close()
+	_, ok := <-ch
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestClient_Watch_RapidChanges(t *testing.T) {
+	c := qt.New(t)
+	srv := newConfigServer(t)
+	srv.setResponseJSON(rootNodeWithKeyValue("key", 0))
+	cfg := srv.config()
+	cfg.PollingMode = Manual
+	client := NewCustomClient(cfg)
+	defer client.Close()
+	c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	ch, cancel := client.Watch(Int("key", -1), nil)
+	defer cancel()
+	c.Assert(receiveDetails(t, ch).Value, qt.Equals, 0)
+
+	// Whatever is dropped along the way, the values arrive
+	// in order and the last one is the most recent.
+	for i := 1; i <= 20; i++ {
+		srv.setResponseJSON(rootNodeWithKeyValue("key", i))
+		c.Assert(client.Refresh(context.Background()), qt.IsNil)
+	}
+	last := 0
+	for last != 20 {
+		value := receiveDetails(t, ch).Value.(int)
+		c.Assert(value > last, qt.IsTrue)
+		last = value
+	}
+	assertNoDetails(t, ch)
+}
+
+func receiveDetails(t *testing.T, ch <-chan EvaluationDetails) EvaluationDetails {
+	select {
+	case details, ok := <-ch:
+		if !ok {
+			t.Fatalf("watch channel closed unexpectedly")
+		}
+		return details
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for watched value")
+		return EvaluationDetails{}
+	}
+}
+
+func assertNoDetails(t *testing.T, ch <-chan EvaluationDetails) {
+	select {
+	case details := <-ch:
+		t.Fatalf("unexpected watched value %v", details.Value)
+	case <-time.After(20 * time.Millisecond):
+	}
+}